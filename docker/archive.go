@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"dagger/docker/internal/dagger"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// where an OCI image layout is extracted in the tools container
+	layoutPath = "/work/layout"
+	// where a layout is archived in the tools container
+	archivePath = "/work/image.tar"
+)
+
+// Build the image for each platform and export it as an OCI image layout directory, e.g. for transfer to a disconnected network.
+//
+// All platform variants are included, with SBOM and provenance attestations attached as referrers
+// if enabled. Publish the layout later with PublishLayout.
+func (m *Docker) ExportLayout(ctx context.Context,
+	// target stage of image build
+	// +optional
+	// +default="ci"
+	target string,
+	// platforms to build with. value of [os]/[arch]/[variant], example: linux/amd64, linux/arm/v7. Defaults to platforms added with WithPlatformMatrix, or linux/amd64.
+	// +optional
+	platforms []dagger.Platform,
+	// tag of the image in the layout
+	// +optional
+	// +default="latest"
+	tag string,
+	// name of an image added with WithImage, required if any were added
+	// +optional
+	image string,
+	// image name recorded in SBOMs and provenance, defaults to the first address added with WithPublish
+	// +optional
+	name string,
+) (*dagger.Directory, error) {
+	platforms = m.platforms(platforms)
+
+	layout, err := m.exportLayout(ctx, image, target, platforms, tag, name, dagger.ImageMediaTypesOcimediaTypes)
+	if err != nil {
+		return nil, err
+	}
+	return layout.Directory(layoutPath), nil
+}
+
+// Build the image for each platform and export it as a `docker save` compatible tarball, e.g. for transfer to a disconnected network.
+//
+// The tarball also contains an OCI image layout with all platform variants, and SBOM and provenance
+// attestations attached as referrers if enabled. Load it with `docker load`, or publish it later
+// with PublishArchive.
+func (m *Docker) ExportArchive(ctx context.Context,
+	// target stage of image build
+	// +optional
+	// +default="ci"
+	target string,
+	// platforms to build with. value of [os]/[arch]/[variant], example: linux/amd64, linux/arm/v7. Defaults to platforms added with WithPlatformMatrix, or linux/amd64.
+	// +optional
+	platforms []dagger.Platform,
+	// tag of the image in the archive
+	// +optional
+	// +default="latest"
+	tag string,
+	// name of an image added with WithImage, required if any were added
+	// +optional
+	image string,
+	// image name recorded in SBOMs and provenance, defaults to the first address added with WithPublish
+	// +optional
+	name string,
+) (*dagger.File, error) {
+	platforms = m.platforms(platforms)
+
+	layout, err := m.exportLayout(ctx, image, target, platforms, tag, name, dagger.ImageMediaTypesDockerMediaTypes)
+	if err != nil {
+		return nil, err
+	}
+	return layout.
+		WithExec([]string{"tar", "-cf", archivePath, "-C", layoutPath, "."}).
+		File(archivePath), nil
+}
+
+// Publish an OCI image layout exported with ExportLayout to every address added with WithPublish, including its referrers.
+//
+// Images are signed if a signing key was added with WithSigningKey.
+//
+// e.g. `oras cp --recursive --from-oci-layout <layout>:<tag> <address>`.
+func (m *Docker) PublishLayout(ctx context.Context,
+	// OCI image layout
+	layout *dagger.Directory,
+	// tag of the image in the layout
+	// +optional
+	// +default="latest"
+	tag string,
+	// name of the image added with WithImage that the layout was exported from, required if any were added
+	// +optional
+	image string,
+) ([]*PublishResult, error) {
+	img, err := m.image(image, "")
+	if err != nil {
+		return nil, err
+	}
+
+	tools := m.tools("oras").WithDirectory(layoutPath, layout)
+
+	// the digest is resolved by publishRefs, so a failed lookup does not copy the layout again
+	results, pubErr := m.publishRefs(ctx, m.pushLimit(), m.imageRefs(img.Name), func(ref string) (string, error) {
+		args := []string{"oras", "cp", "--recursive", "--from-oci-layout", layoutPath + ":" + tag, ref}
+		args = append(args, m.insecureFlag(ref, "--to-plain-http")...)
+		if _, err := tools.WithExec(args).Sync(ctx); err != nil {
+			return "", err
+		}
+		return ref, nil
+	})
+	for _, result := range results {
+		result.Image = img.Name
+	}
+
+	// tags that were published are signed even if others failed, so they can be promoted
+	if err := m.signResults(ctx, results); err != nil {
+		return nil, errors.Join(pubErr, err)
+	}
+	if pubErr != nil {
+		return nil, pubErr
+	}
+	return results, nil
+}
+
+// Publish a tarball exported with ExportArchive to every address added with WithPublish, including its referrers.
+//
+// Images are signed if a signing key was added with WithSigningKey.
+func (m *Docker) PublishArchive(ctx context.Context,
+	// tarball exported with ExportArchive
+	archive *dagger.File,
+	// tag of the image in the archive
+	// +optional
+	// +default="latest"
+	tag string,
+	// name of the image added with WithImage that the archive was exported from, required if any were added
+	// +optional
+	image string,
+) ([]*PublishResult, error) {
+	layout := m.tools().
+		WithMountedFile(archivePath, archive).
+		WithExec([]string{"mkdir", "-p", layoutPath}).
+		WithExec([]string{"tar", "-xf", archivePath, "-C", layoutPath}).
+		Directory(layoutPath)
+
+	return m.PublishLayout(ctx, layout, tag, image)
+}
+
+// exportLayout returns a tools container with the platform variants extracted as an OCI image layout,
+// tagged and with attestations attached if enabled.
+func (docker *Docker) exportLayout(ctx context.Context,
+	image, target string,
+	platforms []dagger.Platform,
+	tag, name string,
+	mediaTypes dagger.ImageMediaTypes,
+) (*dagger.Container, error) {
+	started := time.Now().UTC()
+
+	img, err := docker.image(image, target)
+	if err != nil {
+		return nil, err
+	}
+
+	if name == "" && docker.attestationsEnabled() {
+		refs := docker.imageRefs(img.Name)
+		if len(refs) == 0 {
+			return nil, errors.New("an image name is required for attestations if no address was added with WithPublish")
+		}
+		name = repository(refs[0])
+	}
+
+	platformVariants, err := docker.variants(ctx, img, platforms)
+	if err != nil {
+		return nil, err
+	}
+
+	tarball := dag.Container().AsTarball(dagger.ContainerAsTarballOpts{
+		PlatformVariants: platformVariants,
+		MediaTypes:       mediaTypes,
+	})
+
+	tools := docker.tools("oras", "syft").
+		WithWorkdir("/work").
+		WithMountedFile(archivePath, tarball).
+		WithExec([]string{"mkdir", "-p", layoutPath}).
+		WithExec([]string{"tar", "-xf", archivePath, "-C", layoutPath}).
+		WithoutMount(archivePath)
+
+	blob := func(digest string) (*ociManifest, error) {
+		path := layoutPath + "/blobs/" + strings.Replace(digest, ":", "/", 1)
+		if digest == "" {
+			path = layoutPath + "/index.json"
+		}
+		out, err := tools.File(path).Contents(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", path, err)
+		}
+		var m ociManifest
+		if err := json.Unmarshal([]byte(out), &m); err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", path, err)
+		}
+		return &m, nil
+	}
+
+	index, err := blob("")
+	if err != nil {
+		return nil, err
+	}
+	if len(index.Manifests) != 1 {
+		return nil, fmt.Errorf("expected a single image in the exported layout, found %d", len(index.Manifests))
+	}
+	root := index.Manifests[0].Digest
+
+	if docker.attestationsEnabled() {
+		variants, platforms, sourceDigest, err := docker.attestationInputs(ctx, platformVariants)
+		if err != nil {
+			return nil, err
+		}
+
+		// a single platform is exported as an image manifest, otherwise as an index of platform manifests
+		manifests := []ociDescriptor{{Digest: root}}
+		rootManifest, err := blob(root)
+		if err != nil {
+			return nil, err
+		}
+		if rootManifest.isIndex() {
+			manifests = rootManifest.Manifests
+		}
+
+		sboms := make(map[string]attestation)
+		for _, desc := range manifests {
+			platform := platforms[0]
+			if desc.Platform != nil {
+				platform = dagger.Platform(desc.Platform.String())
+			}
+			ctr, ok := variants[platform]
+			if !ok {
+				return nil, fmt.Errorf("no variant built for exported platform %s", platform)
+			}
+
+			atts, err := docker.attestations(tools, ctr, name, desc.Digest, sourceDigest, img.Target, platform, platforms, started, sboms)
+			if err != nil {
+				return nil, err
+			}
+			for _, att := range atts {
+				args := append(attachArgs(layoutPath+"@"+desc.Digest, att), "--oci-layout")
+				tools = tools.
+					WithFile(att.Name, att.File).
+					WithExec(args)
+			}
+		}
+	}
+
+	return tools.WithExec([]string{"oras", "tag", "--oci-layout", layoutPath + "@" + root, tag}), nil
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"dagger/docker/internal/dagger"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// supported SBOM formats, mapped to the syft output format and artifact media type
+var sbomFormats = map[string]struct {
+	syft      string
+	mediaType string
+	file      string
+}{
+	"spdx":      {syft: "spdx-json", mediaType: "application/spdx+json", file: "sbom.spdx.json"},
+	"cyclonedx": {syft: "cyclonedx-json", mediaType: "application/vnd.cyclonedx+json", file: "sbom.cdx.json"},
+}
+
+const (
+	provenanceMediaType = "application/vnd.in-toto+json"
+	provenanceFile      = "provenance.json"
+
+	// identifies this module as the builder in SLSA provenance
+	provenanceBuilderID = "https://github.com/act3-ai/daggerverse/docker"
+	provenanceBuildType = "https://github.com/act3-ai/daggerverse/docker/build@v1"
+)
+
+// Generate an SBOM from the filesystem of each platform variant and attach it to the published image.
+//
+// SBOMs are attached as OCI referrers of each platform manifest, and returned in PublishResult.
+func (m *Docker) WithSbom(
+	// SBOM format. Supported values: 'spdx' or 'cyclonedx'.
+	// +optional
+	// +default="spdx"
+	format string,
+) (*Docker, error) {
+	if _, ok := sbomFormats[format]; !ok {
+		return nil, fmt.Errorf("unsupported SBOM format %q, expected 'spdx' or 'cyclonedx'", format)
+	}
+	m.Sbom = format
+	return m, nil
+}
+
+// Generate a SLSA provenance attestation for each platform variant and attach it to the published image.
+//
+// Provenance records the source directory digest, build args, target and platforms. It is attached
+// as an OCI referrer of each platform manifest, and returned in PublishResult.
+func (m *Docker) WithProvenance() *Docker {
+	m.Provenance = true
+	return m
+}
+
+// attestation is a file attached to a platform manifest as an OCI referrer.
+type attestation struct {
+	Name      string
+	MediaType string
+	File      *dagger.File
+}
+
+// attestationsEnabled reports whether SBOM or provenance attestations are enabled.
+func (docker *Docker) attestationsEnabled() bool {
+	return docker.Sbom != "" || docker.Provenance
+}
+
+// attest generates the enabled attestations for each published platform manifest, attaches them
+// as referrers, and sets the Attestations directory of each result.
+func (docker *Docker) attest(ctx context.Context,
+	target string,
+	platformVariants []*dagger.Container,
+	results []*PublishResult,
+	started time.Time,
+) error {
+	if !docker.attestationsEnabled() {
+		return nil
+	}
+
+	variants, platforms, sourceDigest, err := docker.attestationInputs(ctx, platformVariants)
+	if err != nil {
+		return err
+	}
+
+	oras := docker.tools("oras", "syft").WithWorkdir("/work")
+
+	// tags of the same build share manifests, so attestations are attached once per repository
+	sboms := make(map[string]attestation)
+	attested := make(map[string]*dagger.Directory)
+	for _, result := range results {
+		repo := repository(result.Ref)
+		dir := dag.Directory()
+
+		for _, pm := range result.Platforms {
+			ctr, ok := variants[pm.Platform]
+			if !ok {
+				return fmt.Errorf("no variant built for published platform %s", pm.Platform)
+			}
+			subject := repo + "@" + pm.Digest
+
+			files, ok := attested[subject]
+			if !ok {
+				atts, err := docker.attestations(oras, ctr, repo, pm.Digest, sourceDigest, target, pm.Platform, platforms, started, sboms)
+				if err != nil {
+					return err
+				}
+
+				files = dag.Directory()
+				for _, att := range atts {
+					files = files.WithFile(att.Name, att.File)
+
+					args := append(attachArgs(subject, att), docker.insecureFlag(subject, "--plain-http")...)
+					if _, err := oras.WithMountedFile(att.Name, att.File).WithExec(args).Sync(ctx); err != nil {
+						return fmt.Errorf("attaching %s to %s: %w", att.MediaType, subject, err)
+					}
+				}
+				attested[subject] = files
+			}
+
+			dir = dir.WithDirectory(platformDir(pm.Platform), files)
+		}
+
+		result.Attestations = dir
+	}
+
+	return nil
+}
+
+// attestationInputs resolves the platform of each variant and, if provenance is enabled, the source digest.
+func (docker *Docker) attestationInputs(ctx context.Context, platformVariants []*dagger.Container) (map[dagger.Platform]*dagger.Container, []dagger.Platform, string, error) {
+	variants := make(map[dagger.Platform]*dagger.Container, len(platformVariants))
+	platforms := make([]dagger.Platform, 0, len(platformVariants))
+	for _, ctr := range platformVariants {
+		platform, err := ctr.Platform(ctx)
+		if err != nil {
+			return nil, nil, "", fmt.Errorf("resolving platform of variant: %w", err)
+		}
+		variants[platform] = ctr
+		platforms = append(platforms, platform)
+	}
+
+	var sourceDigest string
+	if docker.Provenance {
+		var err error
+		sourceDigest, err = docker.Source.Digest(ctx)
+		if err != nil {
+			return nil, nil, "", fmt.Errorf("resolving source digest: %w", err)
+		}
+	}
+
+	return variants, platforms, sourceDigest, nil
+}
+
+// attestations generates the enabled attestations of a platform manifest, using syft from the tools container.
+//
+// SBOMs do not depend on the repository, so they are generated once per digest and kept in sboms.
+func (docker *Docker) attestations(tools *dagger.Container,
+	ctr *dagger.Container,
+	repo, digest, sourceDigest, target string,
+	platform dagger.Platform,
+	platforms []dagger.Platform,
+	started time.Time,
+	sboms map[string]attestation,
+) ([]attestation, error) {
+	var atts []attestation
+
+	if docker.Sbom != "" {
+		sbom, ok := sboms[digest]
+		if !ok {
+			sbom = docker.sbom(tools, ctr, repo)
+			sboms[digest] = sbom
+		}
+		atts = append(atts, sbom)
+	}
+
+	if docker.Provenance {
+		prov, err := docker.provenanceAttestation(repo, digest, sourceDigest, target, platform, platforms, started)
+		if err != nil {
+			return nil, err
+		}
+		atts = append(atts, prov)
+	}
+
+	return atts, nil
+}
+
+// sbom generates an SBOM attestation of a platform variant, using syft from the tools container.
+//
+// The SBOM is named after the image path without the registry, so it is the same in every
+// repository the variant is published to.
+func (docker *Docker) sbom(tools *dagger.Container, ctr *dagger.Container, repo string) attestation {
+	format := sbomFormats[docker.Sbom]
+	sbom := tools.
+		WithMountedDirectory("/rootfs", ctr.Rootfs()).
+		WithExec([]string{"syft", "scan", "dir:/rootfs",
+			"--source-name", imagePath(repo),
+			"--output", format.syft + "=" + format.file,
+		}).
+		File(format.file)
+	return attestation{Name: format.file, MediaType: format.mediaType, File: sbom}
+}
+
+// provenanceAttestation generates a provenance attestation of a platform manifest in a repository.
+func (docker *Docker) provenanceAttestation(repo, digest, sourceDigest, target string,
+	platform dagger.Platform,
+	platforms []dagger.Platform,
+	started time.Time,
+) (attestation, error) {
+	statement, err := docker.provenance(repo, digest, sourceDigest, target, platform, platforms, started)
+	if err != nil {
+		return attestation{}, err
+	}
+	prov := dag.Directory().WithNewFile(provenanceFile, statement).File(provenanceFile)
+	return attestation{Name: provenanceFile, MediaType: provenanceMediaType, File: prov}, nil
+}
+
+// imagePath returns a repository without its registry, e.g. project/app for registry.example.com/project/app.
+func imagePath(repo string) string {
+	host, rest, ok := strings.Cut(repo, "/")
+	if ok && (strings.ContainsAny(host, ".:") || host == "localhost") {
+		return rest
+	}
+	return repo
+}
+
+// attachArgs returns the oras command attaching an attestation, mounted in the working directory, to subject.
+func attachArgs(subject string, att attestation) []string {
+	return []string{"oras", "attach",
+		"--artifact-type", att.MediaType,
+		subject,
+		att.Name + ":" + att.MediaType,
+	}
+}
+
+// inTotoSubject is a software artifact described by an in-toto statement.
+type inTotoSubject struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest"`
+}
+
+// provenance generates a SLSA v1 provenance in-toto statement for a platform manifest.
+func (docker *Docker) provenance(repo, digest, sourceDigest, target string,
+	platform dagger.Platform,
+	platforms []dagger.Platform,
+	started time.Time,
+) (string, error) {
+	buildArgs := make(map[string]string, len(docker.BuildArg))
+	for _, arg := range docker.buildArgs(platform) {
+		buildArgs[arg.Name] = arg.Value
+	}
+
+	statement := map[string]any{
+		"_type":         "https://in-toto.io/Statement/v1",
+		"subject":       []inTotoSubject{digestSubject(repo, digest)},
+		"predicateType": "https://slsa.dev/provenance/v1",
+		"predicate": map[string]any{
+			"buildDefinition": map[string]any{
+				"buildType": provenanceBuildType,
+				"externalParameters": map[string]any{
+					"target":    docker.platformTarget(platform, target),
+					"platforms": platforms,
+					"buildArgs": buildArgs,
+				},
+				"resolvedDependencies": []inTotoSubject{digestSubject("source", sourceDigest)},
+			},
+			"runDetails": map[string]any{
+				"builder": map[string]any{
+					"id": provenanceBuilderID,
+				},
+				"metadata": map[string]any{
+					"startedOn":  started.Format(time.RFC3339),
+					"finishedOn": time.Now().UTC().Format(time.RFC3339),
+				},
+			},
+		},
+	}
+
+	b, err := json.MarshalIndent(statement, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("encoding provenance: %w", err)
+	}
+	return string(b), nil
+}
+
+// digestSubject converts an "<algorithm>:<hex>" digest to an in-toto subject.
+func digestSubject(name, digest string) inTotoSubject {
+	alg, hex, _ := strings.Cut(digest, ":")
+	return inTotoSubject{
+		Name:   name,
+		Digest: map[string]string{alg: hex},
+	}
+}
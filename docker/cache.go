@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"dagger/docker/internal/dagger"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+)
+
+const (
+	// image providing buildkitd, buildctl, and qemu emulators for cross-platform builds
+	imageBuildkit = "docker.io/moby/buildkit" // default: "v0.21.1"
+
+	defaultBuildkitVersion = "v0.21.1"
+	buildkitConfig         = "/etc/buildkit/buildkitd.toml"
+
+	buildkitSecretsDir = "/run/buildkit-secrets"
+	buildkitCacheIn    = "/work/cache-in"
+	buildkitCacheOut   = "/work/cache-out"
+	buildkitImage      = "/work/image.tar"
+)
+
+// Import build cache from a registry reference, e.g. registry.example.com/project/app:buildcache.
+//
+// Builds with imported or exported cache are run with buildkit rather than the engine.
+func (m *Docker) WithCacheFrom(
+	// registry reference of the build cache
+	ref string,
+) *Docker {
+	m.CacheFrom = append(m.CacheFrom, "type=registry,ref="+ref)
+	return m
+}
+
+// Import build cache from a directory previously returned by BuildCache.
+//
+// Builds with imported or exported cache are run with buildkit rather than the engine.
+func (m *Docker) WithCacheFromDirectory(
+	// build cache directory
+	dir *dagger.Directory,
+) *Docker {
+	m.CacheFromDir = dir
+	return m
+}
+
+// Export build cache to a registry reference, e.g. registry.example.com/project/app:buildcache.
+//
+// Builds with imported or exported cache are run with buildkit rather than the engine.
+func (m *Docker) WithCacheTo(
+	// registry reference of the build cache
+	ref string,
+	// cache export mode. Supported values: 'min' (final stage layers only) or 'max' (layers of all stages).
+	// +optional
+	// +default="max"
+	mode string,
+) (*Docker, error) {
+	if mode != "min" && mode != "max" {
+		return nil, fmt.Errorf("unsupported cache mode %q, expected 'min' or 'max'", mode)
+	}
+	m.CacheTo = append(m.CacheTo, fmt.Sprintf("type=registry,ref=%s,mode=%s", ref, mode))
+	return m, nil
+}
+
+// Sets the buildkit version used for builds with imported or exported cache.
+func (m *Docker) WithBuildkitVersion(
+	// buildkit version (image tag)
+	// +optional
+	// +default="v0.21.1"
+	version string,
+) *Docker {
+	m.BuildkitVersion = version
+	return m
+}
+
+// Build the image for each platform, returning the build cache as a directory.
+//
+// Persist the directory between ephemeral CI runners, and import it with WithCacheFromDirectory.
+func (m *Docker) BuildCache(ctx context.Context,
+	// target stage of image build
+	// +optional
+	// +default="ci"
+	target string,
+	// platforms to build with. value of [os]/[arch]/[variant], example: linux/amd64, linux/arm/v7. Defaults to platforms added with WithPlatformMatrix, or linux/amd64.
+	// +optional
+	platforms []dagger.Platform,
+	// name of an image added with WithImage, required if any were added
+	// +optional
+	image string,
+) (*dagger.Directory, error) {
+	platforms = m.platforms(platforms)
+
+	img, err := m.image(image, target)
+	if err != nil {
+		return nil, err
+	}
+
+	_, cache, err := m.buildkit(ctx, img, platforms)
+	return cache, err
+}
+
+// cacheEnabled reports whether build cache is imported or exported.
+func (docker *Docker) cacheEnabled() bool {
+	return len(docker.CacheFrom) > 0 || docker.CacheFromDir != nil || len(docker.CacheTo) > 0
+}
+
+// buildkit builds a container of an image for each platform with buildkit, importing and exporting
+// build cache. The build cache is also exported to the returned directory.
+//
+// Platforms sharing a target and build args are built together. If platforms differ, each group
+// is built separately and its local cache is kept in its own subdirectory.
+//
+// Unlike the engine, buildkit mounts build secrets by ID, so secrets are never read by the module,
+// even if their names differ from their build secret IDs.
+func (docker *Docker) buildkit(ctx context.Context, img Image, platforms []dagger.Platform) ([]*dagger.Container, *dagger.Directory, error) {
+	if err := docker.checkSecrets(ctx, img.Dockerfile); err != nil {
+		return nil, nil, err
+	}
+
+	buildContext, dockerfile, err := docker.buildContext(img)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// group platforms by their target and build args, in order of first appearance
+	var groups [][]dagger.Platform
+	for _, platform := range platforms {
+		i := slices.IndexFunc(groups, func(g []dagger.Platform) bool {
+			return docker.platformTarget(g[0], img.Target) == docker.platformTarget(platform, img.Target) &&
+				slices.Equal(docker.buildArgs(g[0]), docker.buildArgs(platform))
+		})
+		if i < 0 {
+			groups = append(groups, []dagger.Platform{platform})
+		} else {
+			groups[i] = append(groups[i], platform)
+		}
+	}
+
+	config, err := docker.buildkitConfig(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	version := docker.BuildkitVersion
+	if version == "" {
+		version = defaultBuildkitVersion
+	}
+
+	base := dag.Container().
+		From(fmt.Sprintf("%s:%s", imageBuildkit, version)).
+		WithNewFile(buildkitConfig, config).
+		WithEnvVariable("BUILDKITD_FLAGS", "--oci-worker-no-process-sandbox --config "+buildkitConfig).
+		WithMountedDirectory("/work/context", buildContext).
+		With(func(c *dagger.Container) *dagger.Container {
+			for _, svc := range docker.RegistryServices {
+				c = c.WithServiceBinding(svc.Hostname, svc.Service)
+			}
+			// buildkit reads registry credentials from the docker config written by logging in
+			if len(docker.RegistryCreds) > 0 {
+				c = c.WithMountedFile("/root/.docker/config.json", docker.tools().File("/root/.docker/config.json"))
+			}
+			for _, s := range docker.Secrets {
+				c = c.WithMountedSecret(path.Join(buildkitSecretsDir, s.Name), s.Value)
+			}
+			if docker.CacheFromDir != nil {
+				c = c.WithMountedDirectory(buildkitCacheIn, docker.CacheFromDir)
+			}
+			return c
+		})
+
+	variants := make(map[dagger.Platform]*dagger.Container, len(platforms))
+	cache := dag.Directory()
+	for i, group := range groups {
+		cacheDir := ""
+		if len(groups) > 1 {
+			cacheDir = fmt.Sprintf("group-%d", i)
+		}
+
+		platformNames := make([]string, 0, len(group))
+		for _, p := range group {
+			platformNames = append(platformNames, string(p))
+		}
+
+		args := []string{"buildctl-daemonless.sh", "build",
+			"--frontend", "dockerfile.v0",
+			"--local", "context=/work/context",
+			"--local", "dockerfile=/work/context",
+			"--opt", "filename=" + dockerfile,
+			"--opt", "platform=" + strings.Join(platformNames, ","),
+			"--output", "type=oci,dest=" + buildkitImage,
+			"--export-cache", "type=local,mode=max,dest=" + path.Join(buildkitCacheOut, cacheDir),
+		}
+		if target := docker.platformTarget(group[0], img.Target); target != "" {
+			args = append(args, "--opt", "target="+target)
+		}
+		for _, arg := range docker.buildArgs(group[0]) {
+			args = append(args, "--opt", fmt.Sprintf("build-arg:%s=%s", arg.Name, arg.Value))
+		}
+		for _, s := range docker.Secrets {
+			args = append(args, "--secret", fmt.Sprintf("id=%s,src=%s", s.Name, path.Join(buildkitSecretsDir, s.Name)))
+		}
+		for _, from := range docker.CacheFrom {
+			args = append(args, "--import-cache", from)
+		}
+		if docker.CacheFromDir != nil {
+			args = append(args, "--import-cache", "type=local,src="+path.Join(buildkitCacheIn, cacheDir))
+		}
+		for _, to := range docker.CacheTo {
+			args = append(args, "--export-cache", to)
+		}
+
+		ctr := base.WithExec(args, dagger.ContainerWithExecOpts{
+			InsecureRootCapabilities: true,
+		})
+		if _, err := ctr.Sync(ctx); err != nil {
+			return nil, nil, fmt.Errorf("building %s with buildkit: %w", strings.Join(platformNames, ", "), err)
+		}
+
+		image := ctr.File(buildkitImage)
+		for _, platform := range group {
+			variants[platform] = dag.Container(dagger.ContainerOpts{Platform: platform}).Import(image)
+		}
+		cache = cache.WithDirectory(path.Join(".", cacheDir), ctr.Directory(path.Join(buildkitCacheOut, cacheDir)))
+	}
+
+	platformVariants := make([]*dagger.Container, 0, len(platforms))
+	for _, platform := range platforms {
+		platformVariants = append(platformVariants, variants[platform])
+	}
+
+	return platformVariants, cache, nil
+}
+
+// buildkitConfig returns a buildkitd configuration allowing plain HTTP to registries bound with
+// WithRegistryService, e.g. to import and export cache with a test registry.
+func (docker *Docker) buildkitConfig(ctx context.Context) (string, error) {
+	var b strings.Builder
+	for _, svc := range docker.RegistryServices {
+		ports, err := svc.Service.Ports(ctx)
+		if err != nil {
+			return "", fmt.Errorf("resolving ports of registry %s: %w", svc.Hostname, err)
+		}
+
+		hosts := []string{svc.Hostname}
+		for _, port := range ports {
+			number, err := port.Port(ctx)
+			if err != nil {
+				return "", fmt.Errorf("resolving ports of registry %s: %w", svc.Hostname, err)
+			}
+			hosts = append(hosts, fmt.Sprintf("%s:%d", svc.Hostname, number))
+		}
+		for _, host := range hosts {
+			fmt.Fprintf(&b, "[registry.%q]\n  http = true\n  insecure = true\n\n", host)
+		}
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"dagger/docker/internal/dagger"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// maximum number of files listed per section of a diff report
+const maxDiffFiles = 50
+
+// hashFilesScript prints the sha256 hash and path of every file in a directory.
+const hashFilesScript = `cd "$1" && find . -type f -print0 | sort -z | xargs -0r sha256sum`
+
+// imageConfig is the subset of an OCI image config used by this module.
+type imageConfig struct {
+	RootFS struct {
+		DiffIDs []string `json:"diff_ids"`
+	} `json:"rootfs"`
+}
+
+// layer is an image layer, identified by the digest of its uncompressed contents.
+type layer struct {
+	DiffID string
+	Size   int
+}
+
+// imageSummary describes the layers and files of a single platform image.
+type imageSummary struct {
+	Ref    string
+	Size   int
+	Layers []layer
+	Files  map[string]string
+}
+
+// baseSummary describes the layers of the base image of a build, as it currently resolves.
+type baseSummary struct {
+	Ref     string
+	Digest  string
+	DiffIDs []string
+}
+
+// isBaseOf reports whether an image is built on the base, i.e. its bottom layers are the base layers.
+func (base *baseSummary) isBaseOf(s *imageSummary) bool {
+	if len(s.Layers) < len(base.DiffIDs) {
+		return false
+	}
+	for i, diffID := range base.DiffIDs {
+		if s.Layers[i].DiffID != diffID {
+			return false
+		}
+	}
+	return true
+}
+
+// Compare a newly built platform variant with a reference image, returning a markdown report.
+//
+// Reports the total size delta, layers added or removed, files added, removed or changed, and
+// base image drift. Drift is detected by resolving the FROM reference of the target stage, and
+// checking whether the reference image is built on its current layers. Suitable for posting on
+// merge requests.
+func (m *Docker) Diff(ctx context.Context,
+	// reference image, e.g. the currently released registry.example.com/project/app:latest
+	reference string,
+	// target stage of image build
+	// +optional
+	// +default="ci"
+	target string,
+	// platform to compare
+	// +optional
+	// +default="linux/amd64"
+	platform dagger.Platform,
+	// name of an image added with WithImage, required if any were added
+	// +optional
+	image string,
+) (string, error) {
+	img, err := m.image(image, target)
+	if err != nil {
+		return "", err
+	}
+
+	platformVariants, err := m.variants(ctx, img, []dagger.Platform{platform})
+	if err != nil {
+		return "", err
+	}
+
+	built, err := m.summarizeBuilt(ctx, platformVariants[0])
+	if err != nil {
+		return "", err
+	}
+	built.Ref = fmt.Sprintf("%s (built)", target)
+
+	ref, err := m.summarizeRef(ctx, reference, platform)
+	if err != nil {
+		return "", err
+	}
+
+	base, err := m.summarizeBase(ctx, img, platform)
+	if err != nil {
+		return "", err
+	}
+
+	return diffReport(ref, built, base, platform), nil
+}
+
+// summarizeBase resolves the base image of the target stage of an image for a platform.
+// Returns nil if the stage is built from scratch or its base uses build arguments.
+func (docker *Docker) summarizeBase(ctx context.Context, img Image, platform dagger.Platform) (*baseSummary, error) {
+	contents, err := docker.Source.File(img.Dockerfile).Contents(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", img.Dockerfile, err)
+	}
+
+	ref := stageBase(contents, docker.platformTarget(platform, img.Target))
+	if ref == "" || strings.Contains(ref, "$") {
+		return nil, nil
+	}
+
+	crane := docker.tools()
+	flags := append([]string{"--platform", string(platform)}, docker.insecureFlag(ref, "--insecure")...)
+
+	digest, err := crane.WithExec(append([]string{"crane", "digest", ref}, flags...)).Stdout(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("resolving digest of base image %s: %w", ref, err)
+	}
+
+	var config imageConfig
+	out, err := crane.WithExec(append([]string{"crane", "config", ref}, flags...)).Stdout(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("fetching config of base image %s: %w", ref, err)
+	}
+	if err := json.Unmarshal([]byte(out), &config); err != nil {
+		return nil, fmt.Errorf("parsing config of base image %s: %w", ref, err)
+	}
+
+	return &baseSummary{
+		Ref:     ref,
+		Digest:  strings.TrimSpace(digest),
+		DiffIDs: config.RootFS.DiffIDs,
+	}, nil
+}
+
+// summarizeBuilt reads the manifest, config, and files of a built container from its OCI tarball.
+func (docker *Docker) summarizeBuilt(ctx context.Context, ctr *dagger.Container) (*imageSummary, error) {
+	layout := docker.tools().
+		WithMountedFile("/work/image.tar", ctr.AsTarball()).
+		WithExec([]string{"mkdir", "-p", "/work/layout"}).
+		WithExec([]string{"tar", "-xf", "/work/image.tar", "-C", "/work/layout"}).
+		Directory("/work/layout")
+
+	blob := func(digest string) (string, error) {
+		return layout.File("blobs/" + strings.Replace(digest, ":", "/", 1)).Contents(ctx)
+	}
+
+	var index ociManifest
+	out, err := layout.File("index.json").Contents(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("reading built image index: %w", err)
+	}
+	if err := json.Unmarshal([]byte(out), &index); err != nil {
+		return nil, fmt.Errorf("parsing built image index: %w", err)
+	}
+	if len(index.Manifests) == 0 {
+		return nil, errors.New("built image index has no manifests")
+	}
+
+	var manifest ociManifest
+	if out, err = blob(index.Manifests[0].Digest); err != nil {
+		return nil, fmt.Errorf("reading built image manifest: %w", err)
+	}
+	if err := json.Unmarshal([]byte(out), &manifest); err != nil {
+		return nil, fmt.Errorf("parsing built image manifest: %w", err)
+	}
+
+	var config imageConfig
+	if out, err = blob(manifest.Config.Digest); err != nil {
+		return nil, fmt.Errorf("reading built image config: %w", err)
+	}
+	if err := json.Unmarshal([]byte(out), &config); err != nil {
+		return nil, fmt.Errorf("parsing built image config: %w", err)
+	}
+
+	return docker.summarize(ctx, &manifest, &config, ctr.Rootfs())
+}
+
+// summarizeRef reads the manifest, config, and files of a platform of a registry image.
+func (docker *Docker) summarizeRef(ctx context.Context, ref string, platform dagger.Platform) (*imageSummary, error) {
+	crane := docker.tools()
+	flags := append([]string{"--platform", string(platform)}, docker.insecureFlag(ref, "--insecure")...)
+
+	var manifest ociManifest
+	out, err := crane.WithExec(append([]string{"crane", "manifest", ref}, flags...)).Stdout(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("fetching manifest of %s: %w", ref, err)
+	}
+	if err := json.Unmarshal([]byte(out), &manifest); err != nil {
+		return nil, fmt.Errorf("parsing manifest of %s: %w", ref, err)
+	}
+
+	var config imageConfig
+	out, err = crane.WithExec(append([]string{"crane", "config", ref}, flags...)).Stdout(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("fetching config of %s: %w", ref, err)
+	}
+	if err := json.Unmarshal([]byte(out), &config); err != nil {
+		return nil, fmt.Errorf("parsing config of %s: %w", ref, err)
+	}
+
+	rootfs := docker.from(platform, ref).Rootfs()
+	summary, err := docker.summarize(ctx, &manifest, &config, rootfs)
+	if err != nil {
+		return nil, err
+	}
+	summary.Ref = ref
+	return summary, nil
+}
+
+// summarize combines an image's manifest and config with the hashes of its files.
+func (docker *Docker) summarize(ctx context.Context, manifest *ociManifest, config *imageConfig, rootfs *dagger.Directory) (*imageSummary, error) {
+	if len(manifest.Layers) != len(config.RootFS.DiffIDs) {
+		return nil, fmt.Errorf("image has %d layers but %d diff IDs", len(manifest.Layers), len(config.RootFS.DiffIDs))
+	}
+
+	summary := &imageSummary{
+		Size:  manifest.size(),
+		Files: make(map[string]string),
+	}
+	for i, l := range manifest.Layers {
+		summary.Layers = append(summary.Layers, layer{DiffID: config.RootFS.DiffIDs[i], Size: l.Size})
+	}
+
+	out, err := docker.tools().
+		WithMountedDirectory("/work/rootfs", rootfs).
+		WithExec([]string{"sh", "-c", hashFilesScript, "hash", "/work/rootfs"}).
+		Stdout(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("hashing image files: %w", err)
+	}
+	for _, line := range strings.Split(out, "\n") {
+		hash, file, ok := strings.Cut(line, "  ")
+		if ok {
+			summary.Files[strings.TrimPrefix(file, ".")] = hash
+		}
+	}
+
+	return summary, nil
+}
+
+// from returns a container of a registry image, authenticated with the module's registry credentials.
+func (docker *Docker) from(platform dagger.Platform, ref string) *dagger.Container {
+	ctr := dag.Container(dagger.ContainerOpts{Platform: platform})
+	for _, creds := range docker.RegistryCreds {
+		ctr = ctr.WithRegistryAuth(creds.Registry, creds.Username, creds.Password)
+	}
+	return ctr.From(ref)
+}
+
+// diffReport renders a markdown comparison of a reference image and a new image.
+// base is the current base image of the new image, or nil if unknown.
+func diffReport(ref, built *imageSummary, base *baseSummary, platform dagger.Platform) string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "## Image diff: `%s` → `%s` (%s)\n\n", ref.Ref, built.Ref, platform)
+	fmt.Fprintf(&b, "| | Reference | New | Delta |\n|---|---|---|---|\n")
+	fmt.Fprintf(&b, "| Size | %s | %s | %s |\n", humanSize(ref.Size), humanSize(built.Size), sizeDelta(ref.Size, built.Size))
+	fmt.Fprintf(&b, "| Layers | %d | %d | %+d |\n", len(ref.Layers), len(built.Layers), len(built.Layers)-len(ref.Layers))
+	fmt.Fprintf(&b, "| Files | %d | %d | %+d |\n\n", len(ref.Files), len(built.Files), len(built.Files)-len(ref.Files))
+
+	// layers are shared from the bottom up, so the common prefix is the unchanged base
+	shared := 0
+	for shared < len(ref.Layers) && shared < len(built.Layers) && ref.Layers[shared].DiffID == built.Layers[shared].DiffID {
+		shared++
+	}
+
+	b.WriteString("### Base image\n\n")
+	switch {
+	case base != nil && base.isBaseOf(built) && !base.isBaseOf(ref):
+		fmt.Fprintf(&b, "Base image drifted: `%s` now resolves to `%s`, and the reference is built on an older base.\n\n", base.Ref, base.Digest)
+	case base != nil && base.isBaseOf(ref):
+		fmt.Fprintf(&b, "The reference is built on the current base image `%s` (`%s`).\n\n", base.Ref, base.Digest)
+	case shared == 0:
+		b.WriteString("No layers are shared, the base image has changed.\n\n")
+	default:
+		fmt.Fprintf(&b, "The bottom %d of %d reference layers are unchanged.\n\n", shared, len(ref.Layers))
+	}
+
+	refLayers := make(map[string]bool, len(ref.Layers))
+	for _, l := range ref.Layers {
+		refLayers[l.DiffID] = true
+	}
+	builtLayers := make(map[string]bool, len(built.Layers))
+	for _, l := range built.Layers {
+		builtLayers[l.DiffID] = true
+	}
+
+	b.WriteString("### Layers\n\n")
+	for _, l := range built.Layers {
+		if !refLayers[l.DiffID] {
+			fmt.Fprintf(&b, "- added `%s` (%s)\n", l.DiffID, humanSize(l.Size))
+		}
+	}
+	for _, l := range ref.Layers {
+		if !builtLayers[l.DiffID] {
+			fmt.Fprintf(&b, "- removed `%s` (%s)\n", l.DiffID, humanSize(l.Size))
+		}
+	}
+	b.WriteString("\n")
+
+	var added, removed, changed []string
+	for file, hash := range built.Files {
+		refHash, ok := ref.Files[file]
+		switch {
+		case !ok:
+			added = append(added, file)
+		case refHash != hash:
+			changed = append(changed, file)
+		}
+	}
+	for file := range ref.Files {
+		if _, ok := built.Files[file]; !ok {
+			removed = append(removed, file)
+		}
+	}
+
+	b.WriteString("### Files\n\n")
+	writeFiles(&b, "Added", added)
+	writeFiles(&b, "Removed", removed)
+	writeFiles(&b, "Changed", changed)
+
+	return b.String()
+}
+
+// writeFiles writes a collapsible list of files.
+func writeFiles(b *strings.Builder, title string, files []string) {
+	slices.Sort(files)
+	fmt.Fprintf(b, "<details><summary>%s: %d</summary>\n\n", title, len(files))
+	for i, file := range files {
+		if i == maxDiffFiles {
+			fmt.Fprintf(b, "- ... and %d more\n", len(files)-maxDiffFiles)
+			break
+		}
+		fmt.Fprintf(b, "- `%s`\n", file)
+	}
+	b.WriteString("\n</details>\n\n")
+}
+
+// humanSize formats a size in bytes, e.g. 12.3 MB.
+func humanSize(size int) string {
+	const unit = 1000
+	if size < unit && size > -unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	value, exp := float64(size)/unit, 0
+	for value >= unit || value <= -unit {
+		value /= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", value, "kMGTPE"[exp])
+}
+
+// sizeDelta formats the change between two sizes, e.g. +1.2 MB (+10.5%).
+func sizeDelta(from, to int) string {
+	delta := to - from
+	sign := ""
+	if delta > 0 {
+		sign = "+"
+	}
+	if from == 0 {
+		return sign + humanSize(delta)
+	}
+	return fmt.Sprintf("%s%s (%+.1f%%)", sign, humanSize(delta), float64(delta)/float64(from)*100)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// dockerConfig is the subset of a docker config.json used for registry credentials.
+type dockerConfig struct {
+	Auths       map[string]dockerAuth `json:"auths"`
+	CredsStore  string                `json:"credsStore"`
+	CredHelpers map[string]string     `json:"credHelpers"`
+}
+
+// dockerAuth is an entry in the auths of a docker config.json.
+type dockerAuth struct {
+	Username      string `json:"username"`
+	Password      string `json:"password"`
+	Auth          string `json:"auth"`
+	IdentityToken string `json:"identitytoken"`
+	RegistryToken string `json:"registrytoken"`
+}
+
+// identityTokenUsername is the username docker uses to authenticate with an identity token.
+const identityTokenUsername = "<token>"
+
+// credentials returns the username and password of an auths entry. Empty values
+// are returned if the entry has no usable credentials.
+func (a dockerAuth) credentials() (string, string, error) {
+	username, password := a.Username, a.Password
+
+	if a.Auth != "" {
+		decoded, err := base64.StdEncoding.DecodeString(a.Auth)
+		if err != nil {
+			return "", "", fmt.Errorf("decoding auth: %w", err)
+		}
+		var ok bool
+		username, password, ok = strings.Cut(string(decoded), ":")
+		if !ok {
+			return "", "", errors.New("decoded auth is not in the form username:password")
+		}
+	}
+
+	if a.IdentityToken != "" {
+		username, password = identityTokenUsername, a.IdentityToken
+	}
+
+	return username, password, nil
+}
+
+// registryAddress normalizes a docker config auths key, which may be a URL, to a registry host.
+func registryAddress(key string) string {
+	address := strings.TrimPrefix(strings.TrimPrefix(key, "https://"), "http://")
+	address, _, _ = strings.Cut(address, "/")
+	if address == "index.docker.io" || address == "registry-1.docker.io" {
+		return "docker.io"
+	}
+	return address
+}
+
+// warnf prints a warning to stderr, which is shown in the function's output.
+func warnf(format string, a ...any) {
+	fmt.Fprintf(os.Stderr, "WARNING: "+format+"\n", a...)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// gitMetadataScript prints metadata of the git repository in the working directory as key=value lines.
+const gitMetadataScript = `set -e
+git config --global --add safe.directory '*'
+echo "revision=$(git rev-parse HEAD)"
+echo "branch=$(git rev-parse --abbrev-ref HEAD)"
+echo "created=$(git log -1 --format=%cI)"
+echo "describe=$(git describe --tags --always)"
+echo "remote=$(git remote get-url origin 2>/dev/null || true)"
+echo "tags=$(git tag --points-at HEAD | tr '\n' ' ')"
+echo "allTags=$(git tag | tr '\n' ' ')"
+echo "dirty=$(git status --porcelain | head -c1)"
+`
+
+// gitMetadata describes the commit checked out in the source directory.
+type gitMetadata struct {
+	// full commit SHA
+	Revision string
+	// branch name, or "HEAD" if detached
+	Branch string
+	// commit time in RFC 3339 format
+	Created string
+	// output of `git describe --tags --always`
+	Describe string
+	// URL of the origin remote, without credentials
+	Remote string
+	// tags pointing at the commit
+	Tags []string
+	// all tags in the repository
+	AllTags []string
+	// whether the working tree has uncommitted changes
+	Dirty bool
+}
+
+// gitMetadata reads git metadata from the source directory, which must include the .git directory.
+func (docker *Docker) gitMetadata(ctx context.Context) (*gitMetadata, error) {
+	out, err := docker.tools("git").
+		WithMountedDirectory("/work/src", docker.Source).
+		WithWorkdir("/work/src").
+		WithExec([]string{"sh", "-c", gitMetadataScript}).
+		Stdout(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("reading git metadata, the source directory must be a git repository: %w", err)
+	}
+
+	meta := &gitMetadata{}
+	for _, line := range strings.Split(out, "\n") {
+		key, value, _ := strings.Cut(line, "=")
+		switch key {
+		case "revision":
+			meta.Revision = value
+		case "branch":
+			meta.Branch = value
+		case "created":
+			meta.Created = value
+		case "describe":
+			meta.Describe = value
+		case "remote":
+			meta.Remote = remoteURL(value)
+		case "tags":
+			meta.Tags = strings.Fields(value)
+		case "allTags":
+			meta.AllTags = strings.Fields(value)
+		case "dirty":
+			meta.Dirty = value != ""
+		}
+	}
+	return meta, nil
+}
+
+// remoteURL converts a git remote to a browsable https URL without credentials,
+// e.g. git@github.com:org/repo.git becomes https://github.com/org/repo.
+func remoteURL(remote string) string {
+	remote = strings.TrimSuffix(remote, ".git")
+	if remote == "" {
+		return ""
+	}
+
+	// scp-like syntax, user@host:path
+	if !strings.Contains(remote, "://") {
+		if _, hostPath, ok := strings.Cut(remote, "@"); ok {
+			host, p, _ := strings.Cut(hostPath, ":")
+			return "https://" + host + "/" + p
+		}
+		return remote
+	}
+
+	u, err := url.Parse(remote)
+	if err != nil {
+		return ""
+	}
+	u.User = nil
+	if u.Scheme == "ssh" || u.Scheme == "git" {
+		u.Scheme = "https"
+		u.Host = u.Hostname()
+	}
+	return u.String()
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"dagger/docker/internal/dagger"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// defaultDockerfile is used when an image does not specify a Dockerfile.
+const defaultDockerfile = "Dockerfile"
+
+// dockerfileOutsideContext is where a Dockerfile outside of its build context is placed in the context.
+const dockerfileOutsideContext = ".dagger.Dockerfile"
+
+// Image is one of several images built from the same source.
+type Image struct {
+	// Name of the image, appended to each address added with WithPublish.
+	Name string
+	// Path to the Dockerfile, relative to the source directory.
+	Dockerfile string
+	// Build context directory, relative to the source directory.
+	Context string
+	// Target stage of the image build.
+	Target string
+}
+
+// Add an image to builds, allowing several images to be built from one source, e.g. a monorepo.
+//
+// Each image is published to every address added with WithPublish, suffixed with its name,
+// e.g. WithPublish("registry.example.com/project", ["v1"]) publishes image "api" as
+// registry.example.com/project/api:v1.
+func (m *Docker) WithImage(
+	// name of the image
+	name string,
+	// path to the Dockerfile, relative to the source directory
+	// +optional
+	// +default="Dockerfile"
+	dockerfile string,
+	// build context directory, relative to the source directory
+	// +optional
+	// +default="."
+	context string,
+	// target stage of image build, defaults to the target passed to Build
+	// +optional
+	target string,
+) *Docker {
+	m.Images = append(m.Images, Image{
+		Name:       name,
+		Dockerfile: dockerfile,
+		Context:    context,
+		Target:     target,
+	})
+	return m
+}
+
+// defaultImage is built from the Dockerfile at the root of the source directory.
+func defaultImage(target string) Image {
+	return Image{
+		Dockerfile: defaultDockerfile,
+		Context:    ".",
+		Target:     target,
+	}
+}
+
+// images returns the images added with WithImage, or the default image if none were added.
+// Images without a target use the given target.
+func (docker *Docker) images(target string) []Image {
+	if len(docker.Images) == 0 {
+		return []Image{defaultImage(target)}
+	}
+
+	images := make([]Image, 0, len(docker.Images))
+	for _, img := range docker.Images {
+		if img.Target == "" {
+			img.Target = target
+		}
+		images = append(images, img)
+	}
+	return images
+}
+
+// imageRefs returns the references an image is published to.
+func (docker *Docker) imageRefs(name string) []string {
+	if name == "" {
+		return docker.Publish
+	}
+
+	refs := make([]string, 0, len(docker.Publish))
+	for _, ref := range docker.Publish {
+		repo := repository(ref)
+		refs = append(refs, repo+"/"+name+ref[len(repo):])
+	}
+	return refs
+}
+
+// image returns the image added with WithImage named name, or the default image if none were added.
+// An image without a target uses the given target. A name is required if images were added.
+func (docker *Docker) image(name, target string) (Image, error) {
+	if len(docker.Images) == 0 {
+		if name != "" {
+			return Image{}, fmt.Errorf("image %q was not added with WithImage", name)
+		}
+		return defaultImage(target), nil
+	}
+
+	names := make([]string, 0, len(docker.Images))
+	for _, img := range docker.images(target) {
+		if img.Name == name {
+			return img, nil
+		}
+		names = append(names, img.Name)
+	}
+	if name == "" {
+		return Image{}, fmt.Errorf("images were added with WithImage, select one of %s", strings.Join(names, ", "))
+	}
+	return Image{}, fmt.Errorf("image %q was not added with WithImage, expected one of %s", name, strings.Join(names, ", "))
+}
+
+// buildContext returns the build context directory of an image, and the path of its Dockerfile
+// within that context.
+func (docker *Docker) buildContext(img Image) (*dagger.Directory, string, error) {
+	contextDir := path.Clean(img.Context)
+	dockerfile := path.Clean(img.Dockerfile)
+	if outsideSource(contextDir) {
+		return nil, "", fmt.Errorf("build context %q must be relative to the source directory", img.Context)
+	}
+	if outsideSource(dockerfile) {
+		return nil, "", fmt.Errorf("dockerfile %q must be relative to the source directory", img.Dockerfile)
+	}
+
+	buildContext := docker.Source
+	if contextDir != "." {
+		buildContext = docker.Source.Directory(contextDir)
+	}
+
+	if contextDir == "." {
+		return buildContext, dockerfile, nil
+	}
+	if rel, ok := strings.CutPrefix(dockerfile, contextDir+"/"); ok {
+		return buildContext, rel, nil
+	}
+
+	// the Dockerfile is outside of the build context, so copy it in
+	return buildContext.WithFile(dockerfileOutsideContext, docker.Source.File(dockerfile)), dockerfileOutsideContext, nil
+}
+
+// outsideSource reports whether a cleaned path is absolute or escapes the source directory.
+// Names that merely start with "..", e.g. "..docker", are within it.
+func outsideSource(p string) bool {
+	return path.IsAbs(p) || p == ".." || strings.HasPrefix(p, "../")
+}
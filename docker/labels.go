@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+)
+
+// OCI image annotation keys, see https://github.com/opencontainers/image-spec/blob/main/annotations.md
+const (
+	annotationSource   = "org.opencontainers.image.source"
+	annotationRevision = "org.opencontainers.image.revision"
+	annotationCreated  = "org.opencontainers.image.created"
+	annotationVersion  = "org.opencontainers.image.version"
+	annotationLicenses = "org.opencontainers.image.licenses"
+)
+
+// Add org.opencontainers.image.* labels to builds from the git metadata of the source directory.
+//
+// Sets source, revision, created (commit time), version, and licenses. The source directory must
+// include the .git directory. Like all labels, they are also applied as platform manifest annotations.
+func (m *Docker) WithOCILabels(ctx context.Context,
+	// image version, defaults to `git describe --tags --always`
+	// +optional
+	version string,
+	// SPDX license expression, e.g. MIT or Apache-2.0
+	// +optional
+	licenses string,
+) (*Docker, error) {
+	meta, err := m.gitMetadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if version == "" {
+		version = meta.Describe
+	}
+
+	labels := []Labels{
+		{Name: annotationSource, Value: meta.Remote},
+		{Name: annotationRevision, Value: meta.Revision},
+		{Name: annotationCreated, Value: meta.Created},
+		{Name: annotationVersion, Value: version},
+		{Name: annotationLicenses, Value: licenses},
+	}
+	for _, label := range labels {
+		// skip metadata that is unavailable, e.g. a repository without an origin remote
+		if label.Value != "" {
+			m.Labels = append(m.Labels, label)
+		}
+	}
+	return m, nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"dagger/docker/internal/dagger"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// image providing hadolint, defaults to "latest-debian"
+const imageHadolint = "docker.io/hadolint/hadolint"
+
+// hadolint severities that may fail linting, from most to least severe
+var lintThresholds = []string{"error", "warning", "info", "style"}
+
+// hadolint output formats, mapped to report file names
+var lintReports = map[string]string{
+	"tty":                "hadolint.txt",
+	"json":               "hadolint.json",
+	"sarif":              "hadolint.sarif",
+	"gitlab_codeclimate": "gl-code-quality-report.json",
+}
+
+// Lint Dockerfiles before building, failing Build when violations reach the severity.
+func (m *Docker) WithLint(
+	// minimum severity that fails the build. Supported values: 'error', 'warning', 'info', or 'style'.
+	// +optional
+	// +default="error"
+	severity string,
+	// hadolint version (image tag)
+	// +optional
+	// +default="latest-debian"
+	version string,
+) (*Docker, error) {
+	if !slices.Contains(lintThresholds, severity) {
+		return nil, fmt.Errorf("unsupported lint severity %q, expected one of %s", severity, strings.Join(lintThresholds, ", "))
+	}
+	m.LintSeverity = severity
+	m.LintVersion = version
+	return m, nil
+}
+
+// Lint Dockerfiles with hadolint, returning text, JSON, SARIF, and GitLab code quality reports.
+//
+// Fails if violations reach the severity, unless noFail is set, in which case they are listed in
+// failures.txt next to the reports.
+//
+// A .hadolint.yaml configuration file in the source directory is used if present.
+//
+// e.g. `hadolint --format <format> <dockerfile>...`.
+func (m *Docker) Lint(ctx context.Context,
+	// Dockerfiles to lint, relative to the source directory. Defaults to the Dockerfiles of images added with WithImage, or the root Dockerfile.
+	// +optional
+	dockerfiles []string,
+	// minimum severity that fails linting, reports are returned without failing if unset. Supported values: 'error', 'warning', 'info', or 'style'.
+	// +optional
+	severity string,
+	// hadolint version (image tag)
+	// +optional
+	// +default="latest-debian"
+	version string,
+	// return reports without failing, listing violations at or above the severity in failures.txt
+	// +optional
+	noFail bool,
+) (*dagger.Directory, error) {
+	if severity != "" && !slices.Contains(lintThresholds, severity) {
+		return nil, fmt.Errorf("unsupported lint severity %q, expected one of %s", severity, strings.Join(lintThresholds, ", "))
+	}
+
+	if len(dockerfiles) == 0 {
+		dockerfiles = m.dockerfiles()
+	}
+
+	hadolint := dag.Container().
+		From(fmt.Sprintf("%s:%s", imageHadolint, version)).
+		WithWorkdir("/work/src").
+		WithMountedDirectory("/work/src", m.Source)
+
+	reports := dag.Directory()
+	for _, format := range slices.Sorted(maps.Keys(lintReports)) {
+		name := lintReports[format]
+		args := append([]string{"hadolint", "--no-fail", "--no-color", "--format", format}, dockerfiles...)
+		report := hadolint.
+			WithExec(args, dagger.ContainerWithExecOpts{RedirectStdout: "/work/" + name}).
+			File("/work/" + name)
+		reports = reports.WithFile(name, report)
+	}
+
+	if severity == "" {
+		return reports, nil
+	}
+
+	args := append([]string{"hadolint", "--no-color", "--failure-threshold", severity}, dockerfiles...)
+	checked := hadolint.WithExec(args, dagger.ContainerWithExecOpts{Expect: dagger.ReturnTypeAny})
+	code, err := checked.ExitCode(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("linting dockerfiles: %w", err)
+	}
+	if code == 0 {
+		return reports, nil
+	}
+	out, err := checked.Stdout(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("linting dockerfiles: %w", err)
+	}
+	if noFail {
+		return reports.WithNewFile(failuresFile, out), nil
+	}
+	return nil, fmt.Errorf("dockerfile violations at or above %s found:\n%s", severity, out)
+}
+
+// lintGate lints the Dockerfiles if enabled with WithLint, before images are built.
+func (docker *Docker) lintGate(ctx context.Context) error {
+	if docker.LintSeverity == "" {
+		return nil
+	}
+	_, err := docker.Lint(ctx, nil, docker.LintSeverity, docker.LintVersion, false)
+	return err
+}
+
+// dockerfiles returns the Dockerfiles of images added with WithImage, or the root Dockerfile.
+func (docker *Docker) dockerfiles() []string {
+	var dockerfiles []string
+	for _, img := range docker.images("") {
+		if !slices.Contains(dockerfiles, img.Dockerfile) {
+			dockerfiles = append(dockerfiles, img.Dockerfile)
+		}
+	}
+	return dockerfiles
+}
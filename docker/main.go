@@ -18,7 +18,14 @@ import (
 	"context"
 	"dagger/docker/internal/dagger"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"maps"
+	"slices"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
 )
 
 type Docker struct {
@@ -34,6 +41,46 @@ type Docker struct {
 	Labels []Labels
 	// +private
 	Publish []string
+	// +private
+	Sbom string
+	// +private
+	Provenance bool
+	// +private
+	SigningKey *dagger.Secret
+	// +private
+	SigningPassword *dagger.Secret
+	// +private
+	RegistryServices []RegistryService
+	// +private
+	ScanSeverity string
+	// +private
+	ScanDB *dagger.Directory
+	// +private
+	Images []Image
+	// +private
+	CacheFrom []string
+	// +private
+	CacheFromDir *dagger.Directory
+	// +private
+	CacheTo []string
+	// +private
+	BuildkitVersion string
+	// +private
+	LintSeverity string
+	// +private
+	LintVersion string
+	// +private
+	PlatformBuildArgs []PlatformBuildArg
+	// +private
+	PlatformTargets []PlatformTarget
+	// +private
+	Platforms []dagger.Platform
+	// +private
+	PublishConcurrency int
+	// +private
+	PublishAttempts int
+	// +private
+	PublishBackoff string
 }
 
 type Secret struct {
@@ -47,6 +94,11 @@ type RegistryCreds struct {
 	Password *dagger.Secret
 }
 
+type RegistryService struct {
+	Hostname string
+	Service  *dagger.Service
+}
+
 type BuildArgs struct {
 	Name  string
 	Value string
@@ -68,8 +120,11 @@ func New(
 }
 
 // Add a docker secret to builds
+//
+// Secrets are never read by the module. If a secret's name differs from its build secret ID,
+// builds are run with buildkit, which mounts secrets by ID, rather than the engine.
 func (m *Docker) WithSecret(
-	// name of the secret
+	// build secret ID, as used by `RUN --mount=type=secret,id=<name>` in the Dockerfile
 	name string,
 	// value of the secret
 	value *dagger.Secret,
@@ -98,7 +153,27 @@ func (m *Docker) WithRegistryCreds(
 	return m
 }
 
-// Add docker registry creds to builds
+// Bind a registry service, such as registry:2, for registry clients used by this module.
+//
+// The registry is accessed over plain HTTP at the given hostname, e.g. a local registry for tests.
+func (m *Docker) WithRegistryService(
+	// hostname of the registry, without a port
+	hostname string,
+	// registry service
+	service *dagger.Service,
+) *Docker {
+	m.RegistryServices = append(m.RegistryServices, RegistryService{
+		Hostname: hostname,
+		Service:  service,
+	})
+	return m
+}
+
+// Add docker registry creds to builds from a docker config.json.
+//
+// Credentials are read from the username/password, base64 auth, or identitytoken fields of each
+// auths entry. Credential helpers (credHelpers, credsStore) and registry tokens cannot be used
+// inside the module, so they are skipped with a warning. Entries without credentials are skipped.
 func (m *Docker) WithDockerConfig(
 	ctx context.Context,
 	// file path to docker config json
@@ -111,30 +186,47 @@ func (m *Docker) WithDockerConfig(
 		return nil, fmt.Errorf("failed to read docker config: %w", err)
 	}
 
-	// Struct to parse json
-	var config struct {
-		Auths map[string]struct {
-			Username string `json:"username"`
-			Password string `json:"password"`
-		} `json:"auths"`
+	// secrets are named by the config's digest, so registries in different configs do not collide
+	configDigest, err := file.Digest(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to digest docker config: %w", err)
 	}
 
-	// Parse the JSON
+	var config dockerConfig
 	if err := json.Unmarshal([]byte(configData), &config); err != nil {
 		return nil, fmt.Errorf("failed to parse docker config JSON: %w", err)
 	}
 
-	// Extract and append credentials
-	for registry, creds := range config.Auths {
-		daggerSecret := dag.SetSecret(registry, creds.Password)
+	if config.CredsStore != "" {
+		warnf("docker config credsStore %q is not supported, only credentials stored in auths are used", config.CredsStore)
+	}
+	for _, registry := range slices.Sorted(maps.Keys(config.CredHelpers)) {
+		warnf("docker config credHelpers entry for %s is not supported, use WithRegistryCreds instead", registry)
+	}
+
+	// Extract and append credentials, sorted for a stable order
+	for _, registry := range slices.Sorted(maps.Keys(config.Auths)) {
+		username, password, err := config.Auths[registry].credentials()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read docker config credentials for %s: %w", registry, err)
+		}
+		if username == "" || password == "" {
+			if config.Auths[registry].RegistryToken != "" {
+				warnf("docker config registrytoken for %s is not supported, skipping", registry)
+			}
+			continue
+		}
+
+		address := registryAddress(registry)
+		daggerSecret := dag.SetSecret(fmt.Sprintf("docker-config-%s-%s", configDigest, address), password)
 
 		m.RegistryCreds = append(m.RegistryCreds, RegistryCreds{
-			Registry: registry,
-			Username: creds.Username,
+			Registry: address,
+			Username: username,
 			Password: daggerSecret,
 		})
 	}
-	return m, err
+	return m, nil
 }
 
 // Add docker build args to builds
@@ -151,7 +243,7 @@ func (m *Docker) WithBuildArg(
 	return m
 }
 
-// Add labels to builds
+// Add labels to builds. Labels are also applied as annotations of each platform manifest when published.
 func (m *Docker) WithLabel(
 	// name of the secret
 	name string,
@@ -178,60 +270,191 @@ func (m *Docker) WithPublish(
 	return m
 }
 
-// Retrieve secrets and set them in Dagger with dynamic names
-func (m *Docker) getSecrets(ctx context.Context) (map[string]*dagger.Secret, error) {
+// Limit how many tags are published at once.
+func (m *Docker) WithPublishConcurrency(
+	// maximum number of tags published in parallel
+	// +optional
+	// +default=4
+	limit int,
+) (*Docker, error) {
+	if limit < 1 {
+		return nil, fmt.Errorf("publish concurrency must be at least 1, got %d", limit)
+	}
+	m.PublishConcurrency = limit
+	return m, nil
+}
+
+// Retry publishing a tag on transient registry errors, e.g. rate limits, server errors, or timeouts.
+//
+// The delay between attempts doubles after each retry.
+func (m *Docker) WithPublishRetry(
+	// maximum number of attempts for each tag, including the first
+	// +optional
+	// +default=3
+	attempts int,
+	// delay before the first retry, as a Go duration, e.g. 500ms or 2s
+	// +optional
+	// +default="1s"
+	backoff string,
+) (*Docker, error) {
+	if attempts < 1 {
+		return nil, fmt.Errorf("publish attempts must be at least 1, got %d", attempts)
+	}
+	if _, err := time.ParseDuration(backoff); err != nil {
+		return nil, fmt.Errorf("invalid publish backoff %q: %w", backoff, err)
+	}
+	m.PublishAttempts = attempts
+	m.PublishBackoff = backoff
+	return m, nil
+}
+
+// Build the image for each platform and publish it to every address added with WithPublish.
+//
+// Images added with WithImage are built and published in parallel, as are their tags. The limit
+// added with WithPublishConcurrency applies to the tags of all images together.
+// If some tags fail to publish, the error lists the tags that succeeded.
+func (docker *Docker) Build(
+	ctx context.Context,
+	// target stage of image build, unless overridden by WithImage
+	// +optional
+	// +default="ci"
+	target string,
+	// platforms to build with. value of [os]/[arch]/[variant], example: linux/amd64, linux/arm/v7. Defaults to platforms added with WithPlatformMatrix, or linux/amd64.
+	// +optional
+	platforms []dagger.Platform) ([]*PublishResult, error) {
+	platforms = docker.platforms(platforms)
 
-	secretMap := make(map[string]*dagger.Secret)
+	if err := docker.lintGate(ctx); err != nil {
+		return nil, err
+	}
 
-	for _, s := range m.Secrets {
-		plaintext, err := s.Value.Plaintext(ctx)
-		if err != nil {
-			return nil, fmt.Errorf("failed to get the secret value in plaintext for %s: %w", s.Name, err)
+	images := docker.images(target)
+	results := make([][]*PublishResult, len(images))
+	errs := make([]error, len(images))
+
+	// images are not cancelled when another fails, so every error lists the tags it published
+	pushes := docker.pushLimit()
+	var g errgroup.Group
+	for i, img := range images {
+		g.Go(func() error {
+			var err error
+			results[i], err = docker.buildAndPublish(ctx, pushes, img, platforms)
+			if err != nil && img.Name != "" {
+				err = fmt.Errorf("image %s: %w", img.Name, err)
+			}
+			errs[i] = err
+			return nil
+		})
+	}
+	_ = g.Wait()
+	if err := errors.Join(errs...); err != nil {
+		// also report images that were fully published
+		for _, imageResults := range results {
+			for _, result := range imageResults {
+				err = fmt.Errorf("%w\nsucceeded: %s", err, result.PinnedRef())
+			}
 		}
+		return nil, err
+	}
+
+	return slices.Concat(results...), nil
+}
+
+// buildAndPublish builds, scans, publishes, and signs a single image.
+func (docker *Docker) buildAndPublish(ctx context.Context, pushes *semaphore.Weighted, img Image, platforms []dagger.Platform) ([]*PublishResult, error) {
+	platformVariants, err := docker.variants(ctx, img, platforms)
+	if err != nil {
+		return nil, err
+	}
 
-		// Set secret dynamically based on the original name
-		secretMap[s.Name] = dag.SetSecret(s.Name, plaintext)
+	if err := docker.scanGate(ctx, platforms, platformVariants); err != nil {
+		return nil, err
 	}
 
-	return secretMap, nil
+	return docker.publish(ctx, pushes, img, platformVariants)
 }
 
-func (docker *Docker) Build(
+// Build the image for each platform without publishing, returning the platform variants.
+//
+// Useful for testing or scanning an image before anything is pushed.
+func (docker *Docker) Containers(
 	ctx context.Context,
 	// target stage of image build
 	// +optional
 	// +default="ci"
 	target string,
-	// platforms to build with. value of [os]/[arch], example: linux/amd64, linux/arm64
-	// +default=["linux/amd64"]
-	platforms []dagger.Platform) ([]string, error) {
+	// platforms to build with. value of [os]/[arch]/[variant], example: linux/amd64, linux/arm/v7. Defaults to platforms added with WithPlatformMatrix, or linux/amd64.
+	// +optional
+	platforms []dagger.Platform,
+	// name of an image added with WithImage, required if any were added
+	// +optional
+	image string,
+) ([]*dagger.Container, error) {
+	platforms = docker.platforms(platforms)
 
-	//get secrets
-	secrets, err := docker.getSecrets(ctx)
+	img, err := docker.image(image, target)
 	if err != nil {
 		return nil, err
 	}
 
-	// Convert secret map to a slice
-	var secretSlice []*dagger.Secret
-	for _, secret := range secrets {
-		secretSlice = append(secretSlice, secret)
+	return docker.variants(ctx, img, platforms)
+}
+
+// Build the image for each platform without publishing, exporting all platform variants as a single multi-platform OCI tarball.
+func (docker *Docker) Tarball(
+	ctx context.Context,
+	// target stage of image build
+	// +optional
+	// +default="ci"
+	target string,
+	// platforms to build with. value of [os]/[arch]/[variant], example: linux/amd64, linux/arm/v7. Defaults to platforms added with WithPlatformMatrix, or linux/amd64.
+	// +optional
+	platforms []dagger.Platform,
+	// name of an image added with WithImage, required if any were added
+	// +optional
+	image string,
+) (*dagger.File, error) {
+	platforms = docker.platforms(platforms)
+
+	img, err := docker.image(image, target)
+	if err != nil {
+		return nil, err
 	}
 
-	//check for platforms and build each one
-	platformVariants := make([]*dagger.Container, 0, len(platforms))
-	for _, platform := range platforms {
-		// Create an instance of `Ctr` (container)
-		ctr := docker.Source.DockerBuild(dagger.DirectoryDockerBuildOpts{
-			Target:    target,
-			Secrets:   secretSlice,
-			BuildArgs: docker.BuildArg,
-			Platform:  platform,
-		})
+	platformVariants, err := docker.variants(ctx, img, platforms)
+	if err != nil {
+		return nil, err
+	}
+
+	return dag.Container().AsTarball(dagger.ContainerAsTarballOpts{
+		PlatformVariants: platformVariants,
+	}), nil
+}
+
+// variants builds a container of an image for each platform, with labels and registry credentials applied.
+func (docker *Docker) variants(ctx context.Context, img Image, platforms []dagger.Platform) ([]*dagger.Container, error) {
+	// the engine cannot import or export build cache, nor rename secrets without reading them,
+	// so build with buildkit instead
+	useBuildkit, err := docker.renamedSecrets(ctx)
+	if err != nil {
+		return nil, err
+	}
 
-		//Apply labels to each container
+	var platformVariants []*dagger.Container
+	if useBuildkit || docker.cacheEnabled() {
+		platformVariants, _, err = docker.buildkit(ctx, img, platforms)
+	} else {
+		platformVariants, err = docker.dockerBuild(ctx, img, platforms)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for i, ctr := range platformVariants {
+		//Apply labels to each container, and as annotations of its manifest when published
 		for _, label := range docker.Labels {
-			ctr = ctr.WithLabel(label.Name, label.Value)
+			ctr = ctr.WithLabel(label.Name, label.Value).
+				WithAnnotation(label.Name, label.Value)
 		}
 
 		//Apply registry authentication for each set of credentials
@@ -239,20 +462,38 @@ func (docker *Docker) Build(
 			ctr = ctr.WithRegistryAuth(creds.Registry, creds.Username, creds.Password)
 		}
 
-		platformVariants = append(platformVariants, ctr)
+		platformVariants[i] = ctr
+	}
+
+	return platformVariants, nil
+}
+
+// dockerBuild builds a container of an image for each platform with the engine.
+func (docker *Docker) dockerBuild(ctx context.Context, img Image, platforms []dagger.Platform) ([]*dagger.Container, error) {
+	secrets, err := docker.buildSecrets(ctx, img.Dockerfile)
+	if err != nil {
+		return nil, err
+	}
+
+	buildContext, dockerfile, err := docker.buildContext(img)
+	if err != nil {
+		return nil, err
 	}
 
-	// Publish tags to registry
-	var addr []string
-	for _, imageRef := range docker.Publish {
-		a, err := dag.Container().Publish(ctx, imageRef, dagger.ContainerPublishOpts{
-			PlatformVariants: platformVariants,
+	//check for platforms and build each one
+	platformVariants := make([]*dagger.Container, 0, len(platforms))
+	for _, platform := range platforms {
+		// Create an instance of `Ctr` (container)
+		ctr := buildContext.DockerBuild(dagger.DirectoryDockerBuildOpts{
+			Dockerfile: dockerfile,
+			Target:     docker.platformTarget(platform, img.Target),
+			Secrets:    secrets,
+			BuildArgs:  docker.buildArgs(platform),
+			Platform:   platform,
 		})
-		if err != nil {
-			return nil, err
-		}
-		addr = append(addr, a)
+
+		platformVariants = append(platformVariants, ctr)
 	}
 
-	return addr, err
+	return platformVariants, nil
 }
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"dagger/docker/internal/dagger"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// name of the report returned by PinBaseImages
+const pinReport = "base-images.md"
+
+// fromRegexp matches a FROM instruction, capturing its prefix with flags, image reference, and remainder.
+var fromRegexp = regexp.MustCompile(`(?i)^(\s*FROM\s+(?:--\S+\s+)*)(\S+)(.*)$`)
+
+// stageRegexp matches the stage name of a FROM instruction remainder.
+var stageRegexp = regexp.MustCompile(`(?i)^\s+AS\s+(\S+)`)
+
+// status of a base image after pinning
+const (
+	pinPinned    = "pinned"
+	pinUpdated   = "updated"
+	pinUnchanged = "up to date"
+	pinSkipped   = "skipped"
+)
+
+// baseImage is a FROM reference in a Dockerfile.
+type baseImage struct {
+	Dockerfile string
+	Ref        string
+	// digest the reference was pinned to, if any
+	Previous string
+	// digest the tag currently points to
+	Current string
+	Status  string
+	Reason  string
+}
+
+// Pin every FROM reference in the Dockerfiles to the digest its tag currently points to, for reproducible builds.
+//
+// Returns the rewritten Dockerfiles at their paths, relative to the source directory, and a markdown
+// report (base-images.md) of base images that were pinned or whose tags now point to new digests.
+// References are rewritten as <image>:<tag>@<digest>, so they can be checked again later.
+//
+// References using build arguments, digests without a tag, scratch, and earlier stages are left unchanged.
+func (m *Docker) PinBaseImages(ctx context.Context,
+	// Dockerfiles to pin, relative to the source directory. Defaults to the Dockerfiles of images added with WithImage, or the root Dockerfile.
+	// +optional
+	dockerfiles []string,
+) (*dagger.Directory, error) {
+	if len(dockerfiles) == 0 {
+		dockerfiles = m.dockerfiles()
+	}
+
+	crane := m.tools()
+	digests := make(map[string]string)
+	resolve := func(ref string) (string, error) {
+		if digest, ok := digests[ref]; ok {
+			return digest, nil
+		}
+		args := append([]string{"crane", "digest", ref}, m.insecureFlag(ref, "--insecure")...)
+		out, err := crane.WithExec(args).Stdout(ctx)
+		if err != nil {
+			return "", fmt.Errorf("resolving digest of %s: %w", ref, err)
+		}
+		digests[ref] = strings.TrimSpace(out)
+		return digests[ref], nil
+	}
+
+	pinned := dag.Directory()
+	var bases []baseImage
+	for _, dockerfile := range dockerfiles {
+		contents, err := m.Source.File(dockerfile).Contents(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", dockerfile, err)
+		}
+
+		stages := make(map[string]bool)
+		lines := strings.Split(contents, "\n")
+		for i, line := range lines {
+			match := fromRegexp.FindStringSubmatch(line)
+			if match == nil {
+				continue
+			}
+			prefix, ref, rest := match[1], match[2], match[3]
+			isStage := stages[strings.ToLower(ref)]
+			if stage := stageRegexp.FindStringSubmatch(rest); stage != nil {
+				stages[strings.ToLower(stage[1])] = true
+			}
+			if isStage || strings.EqualFold(ref, "scratch") {
+				continue
+			}
+
+			base := baseImage{Dockerfile: dockerfile, Ref: ref}
+			name, previous, _ := strings.Cut(ref, "@")
+			base.Previous = previous
+
+			switch {
+			case strings.Contains(ref, "$"):
+				base.Status, base.Reason = pinSkipped, "uses build arguments"
+			case previous != "" && !hasTag(name):
+				base.Status, base.Reason = pinSkipped, "pinned without a tag"
+			default:
+				if !hasTag(name) {
+					name += ":latest"
+				}
+				current, err := resolve(name)
+				if err != nil {
+					return nil, err
+				}
+				base.Current = current
+
+				switch previous {
+				case "":
+					base.Status = pinPinned
+				case current:
+					base.Status = pinUnchanged
+				default:
+					base.Status = pinUpdated
+				}
+				lines[i] = prefix + name + "@" + current + rest
+			}
+			bases = append(bases, base)
+		}
+
+		pinned = pinned.WithNewFile(dockerfile, strings.Join(lines, "\n"))
+	}
+
+	return pinned.WithNewFile(pinReport, pinReportMarkdown(bases)), nil
+}
+
+// stageBase returns the base image reference of a Dockerfile stage, following references to earlier
+// stages. The last stage is used if target is empty or not found. Empty if the stage is built from scratch.
+func stageBase(contents, target string) string {
+	stages := make(map[string]string)
+	var last string
+	for _, line := range strings.Split(contents, "\n") {
+		match := fromRegexp.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		ref := match[2]
+		if base, ok := stages[strings.ToLower(ref)]; ok {
+			ref = base
+		}
+		last = ref
+		if stage := stageRegexp.FindStringSubmatch(match[3]); stage != nil {
+			stages[strings.ToLower(stage[1])] = ref
+		}
+	}
+
+	if base, ok := stages[strings.ToLower(target)]; ok {
+		last = base
+	}
+	if strings.EqualFold(last, "scratch") {
+		return ""
+	}
+	return last
+}
+
+// hasTag reports whether an image reference without a digest has a tag.
+func hasTag(name string) bool {
+	return strings.Contains(name[strings.LastIndex(name, "/")+1:], ":")
+}
+
+// pinReportMarkdown formats a markdown report of pinned base images.
+func pinReportMarkdown(bases []baseImage) string {
+	var updated int
+	for _, base := range bases {
+		if base.Status == pinUpdated {
+			updated++
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString("## Base images\n\n")
+	fmt.Fprintf(&b, "%d of %d base images have tags pointing to new digests.\n\n", updated, len(bases))
+	if len(bases) == 0 {
+		return b.String()
+	}
+
+	b.WriteString("| Dockerfile | Image | Pinned digest | Current digest | Status |\n")
+	b.WriteString("|---|---|---|---|---|\n")
+	for _, base := range bases {
+		status := base.Status
+		if base.Reason != "" {
+			status += ": " + base.Reason
+		}
+		fmt.Fprintf(&b, "| `%s` | `%s` | %s | %s | %s |\n",
+			base.Dockerfile, base.Ref, shortDigest(base.Previous), shortDigest(base.Current), status)
+	}
+	return b.String()
+}
+
+// shortDigest abbreviates a digest for reports, e.g. sha256:0123456789ab.
+func shortDigest(digest string) string {
+	if digest == "" {
+		return "-"
+	}
+	algorithm, hex, _ := strings.Cut(digest, ":")
+	if len(hex) > 12 {
+		hex = hex[:12]
+	}
+	return "`" + algorithm + ":" + hex + "`"
+}
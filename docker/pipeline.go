@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"dagger/docker/internal/dagger"
+	"errors"
+	"fmt"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// Build the ci target, test each platform variant, and publish the release target only if every test passes.
+//
+// Tests are either a command run in each ci platform variant, a Dockerfile stage whose build runs the tests, or both.
+func (docker *Docker) Pipeline(
+	ctx context.Context,
+	// target stage of the image to test
+	// +optional
+	// +default="ci"
+	ciTarget string,
+	// target stage of the image to publish, defaults to the target of the image added with WithImage, or the last stage in the Dockerfile
+	// +optional
+	releaseTarget string,
+	// command run in each ci platform variant, example: ["make", "test"]
+	// +optional
+	testCmd []string,
+	// target stage that runs the tests when built
+	// +optional
+	testStage string,
+	// platforms to build with. value of [os]/[arch]/[variant], example: linux/amd64, linux/arm/v7. Defaults to platforms added with WithPlatformMatrix, or linux/amd64.
+	// +optional
+	platforms []dagger.Platform,
+	// name of an image added with WithImage, required if any were added
+	// +optional
+	image string,
+) ([]*PublishResult, error) {
+	platforms = docker.platforms(platforms)
+
+	if len(testCmd) == 0 && testStage == "" {
+		return nil, errors.New("at least one of testCmd or testStage is required")
+	}
+
+	img, err := docker.image(image, "")
+	if err != nil {
+		return nil, err
+	}
+	// the stages of the pipeline override the target of the image, if set
+	stage := func(target string) Image {
+		img := img
+		if target != "" {
+			img.Target = target
+		}
+		return img
+	}
+
+	if err := docker.lintGate(ctx); err != nil {
+		return nil, err
+	}
+
+	if len(testCmd) > 0 {
+		ciVariants, err := docker.variants(ctx, stage(ciTarget), platforms)
+		if err != nil {
+			return nil, err
+		}
+		err = testVariants(ctx, platforms, ciVariants, func(ctr *dagger.Container) *dagger.Container {
+			return ctr.WithExec(testCmd)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("testing target %q: %w", ciTarget, err)
+		}
+	}
+
+	if testStage != "" {
+		testVars, err := docker.variants(ctx, stage(testStage), platforms)
+		if err != nil {
+			return nil, err
+		}
+		err = testVariants(ctx, platforms, testVars, func(ctr *dagger.Container) *dagger.Container {
+			return ctr
+		})
+		if err != nil {
+			return nil, fmt.Errorf("testing stage %q: %w", testStage, err)
+		}
+	}
+
+	releaseVariants, err := docker.variants(ctx, stage(releaseTarget), platforms)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := docker.scanGate(ctx, platforms, releaseVariants); err != nil {
+		return nil, err
+	}
+
+	return docker.publish(ctx, docker.pushLimit(), stage(releaseTarget), releaseVariants)
+}
+
+// testVariants runs test against every platform variant in parallel, returning the failures of all platforms.
+func testVariants(ctx context.Context,
+	platforms []dagger.Platform,
+	variants []*dagger.Container,
+	test func(*dagger.Container) *dagger.Container,
+) error {
+	errs := make([]error, len(variants))
+
+	var g errgroup.Group
+	for i, ctr := range variants {
+		g.Go(func() error {
+			if _, err := test(ctr).Sync(ctx); err != nil {
+				errs[i] = fmt.Errorf("platform %s: %w", platforms[i], err)
+			}
+			return nil
+		})
+	}
+	_ = g.Wait()
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"dagger/docker/internal/dagger"
+	"slices"
+)
+
+// defaultPlatform is built when no platforms are given.
+const defaultPlatform dagger.Platform = "linux/amd64"
+
+type PlatformBuildArg struct {
+	Platform dagger.Platform
+	Name     string
+	Value    string
+}
+
+type PlatformTarget struct {
+	Platform dagger.Platform
+	Target   string
+}
+
+// Add a docker build arg to builds of a single platform, overriding a build arg of the same name
+// added with WithBuildArg, e.g. a different base image digest or download URL for linux/arm64.
+func (m *Docker) WithPlatformBuildArg(
+	// platform the build arg applies to, example: linux/arm64
+	platform dagger.Platform,
+	// name of the build arg
+	name string,
+	// value of the build arg
+	value string,
+) *Docker {
+	m.PlatformBuildArgs = append(m.PlatformBuildArgs, PlatformBuildArg{
+		Platform: platform,
+		Name:     name,
+		Value:    value,
+	})
+	return m
+}
+
+// Override the target stage of builds for a single platform.
+func (m *Docker) WithPlatformTarget(
+	// platform the target applies to, example: linux/arm/v7
+	platform dagger.Platform,
+	// target stage of image build
+	target string,
+) *Docker {
+	m.PlatformTargets = append(m.PlatformTargets, PlatformTarget{
+		Platform: platform,
+		Target:   target,
+	})
+	return m
+}
+
+// Add the platforms of an os and architecture matrix to builds, used when a build is not given platforms.
+//
+// e.g. os ["linux"] and arch ["amd64", "arm64", "arm/v7"] adds linux/amd64, linux/arm64, and linux/arm/v7.
+func (m *Docker) WithPlatformMatrix(
+	// operating systems
+	// +optional
+	// +default=["linux"]
+	os []string,
+	// architectures, optionally with a variant, example: amd64, arm64, arm/v7
+	arch []string,
+) *Docker {
+	for _, o := range os {
+		for _, a := range arch {
+			platform := dagger.Platform(o + "/" + a)
+			if !slices.Contains(m.Platforms, platform) {
+				m.Platforms = append(m.Platforms, platform)
+			}
+		}
+	}
+	return m
+}
+
+// platforms returns the given platforms, or the platforms added with WithPlatformMatrix, or the default platform.
+func (docker *Docker) platforms(platforms []dagger.Platform) []dagger.Platform {
+	switch {
+	case len(platforms) > 0:
+		return platforms
+	case len(docker.Platforms) > 0:
+		return docker.Platforms
+	default:
+		return []dagger.Platform{defaultPlatform}
+	}
+}
+
+// buildArgs returns the build args of a platform, with build args added with WithPlatformBuildArg
+// overriding those added with WithBuildArg.
+func (docker *Docker) buildArgs(platform dagger.Platform) []dagger.BuildArg {
+	args := slices.Clone(docker.BuildArg)
+	for _, arg := range docker.PlatformBuildArgs {
+		if arg.Platform != platform {
+			continue
+		}
+		i := slices.IndexFunc(args, func(a dagger.BuildArg) bool { return a.Name == arg.Name })
+		if i < 0 {
+			args = append(args, dagger.BuildArg{Name: arg.Name, Value: arg.Value})
+		} else {
+			args[i].Value = arg.Value
+		}
+	}
+	return args
+}
+
+// platformTarget returns the target of a platform added with WithPlatformTarget, or target.
+func (docker *Docker) platformTarget(platform dagger.Platform, target string) string {
+	for _, t := range docker.PlatformTargets {
+		if t.Platform == platform {
+			target = t.Target
+		}
+	}
+	return target
+}
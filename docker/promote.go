@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"dagger/docker/internal/dagger"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Copy a published image to another registry without rebuilding, e.g. from staging to production.
+//
+// All platform variants are copied, along with referrers (SBOMs and provenance) and cosign
+// signatures. Registry credentials added with WithRegistryCreds or WithDockerConfig are used
+// for both registries.
+//
+// e.g. `oras cp --recursive <src> <dst>:<tags>` and `cosign copy --only=sig,att,sbom <src> <dst>`.
+func (m *Docker) Promote(ctx context.Context,
+	// source image reference, e.g. staging.example.com/project/app:v1.2.3
+	src string,
+	// destination repository, without a tag, e.g. registry.example.com/project/app
+	dst string,
+	// tags to copy to, defaults to the tag of the source reference
+	// +optional
+	tags []string,
+) ([]*PublishResult, error) {
+	if len(tags) == 0 {
+		srcName, _, _ := strings.Cut(src, "@")
+		repo := repository(srcName)
+		if len(srcName) == len(repo) {
+			return nil, fmt.Errorf("source reference %s has no tag, tags must be provided", src)
+		}
+		tags = []string{srcName[len(repo)+1:]}
+	}
+
+	tools := m.tools("oras", "cosign")
+
+	// oras pushes every tag in one copy when they are comma separated
+	args := []string{"oras", "cp", "--recursive", src, dst + ":" + strings.Join(tags, ",")}
+	args = append(args, m.insecureFlag(src, "--from-plain-http")...)
+	args = append(args, m.insecureFlag(dst, "--to-plain-http")...)
+	if _, err := tools.WithExec(args).Sync(ctx); err != nil {
+		return nil, fmt.Errorf("copying %s to %s: %w", src, dst, err)
+	}
+
+	signed, err := m.signed(ctx, tools, src)
+	if err != nil {
+		return nil, err
+	}
+	if signed {
+		args := []string{"cosign", "copy", "--only=sig,att,sbom", "--force"}
+		args = append(args, m.insecureFlag(src, "--allow-insecure-registry")...)
+		args = append(args, m.insecureFlag(dst, "--allow-insecure-registry")...)
+		if _, err := tools.WithExec(append(args, src, dst+":"+tags[0])).Sync(ctx); err != nil {
+			return nil, fmt.Errorf("copying signatures of %s to %s: %w", src, dst, err)
+		}
+	}
+
+	results := make([]*PublishResult, 0, len(tags))
+	for _, tag := range tags {
+		ref := dst + ":" + tag
+		args := append([]string{"crane", "digest", ref}, m.insecureFlag(ref, "--insecure")...)
+		digest, err := tools.WithExec(args).Stdout(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("resolving digest of %s: %w", ref, err)
+		}
+
+		result, err := m.inspect(ctx, ref+"@"+strings.TrimSpace(digest))
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, result)
+	}
+
+	return results, nil
+}
+
+// signed reports whether an image has a cosign signature, stored in the registry as a
+// sha256-<hex>.sig tag of the image's repository.
+func (docker *Docker) signed(ctx context.Context, tools *dagger.Container, ref string) (bool, error) {
+	digestArgs := append([]string{"crane", "digest", ref}, docker.insecureFlag(ref, "--insecure")...)
+	digest, err := tools.WithExec(digestArgs).Stdout(ctx)
+	if err != nil {
+		return false, fmt.Errorf("resolving digest of %s: %w", ref, err)
+	}
+
+	repo := repository(ref)
+	lsArgs := append([]string{"crane", "ls", repo}, docker.insecureFlag(ref, "--insecure")...)
+	out, err := tools.WithExec(lsArgs).Stdout(ctx)
+	if err != nil {
+		return false, fmt.Errorf("listing tags of %s: %w", repo, err)
+	}
+
+	sigTag := strings.Replace(strings.TrimSpace(digest), ":", "-", 1) + ".sig"
+	return slices.Contains(strings.Fields(out), sigTag), nil
+}
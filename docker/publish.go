@@ -0,0 +1,418 @@
+package main
+
+import (
+	"context"
+	"dagger/docker/internal/dagger"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
+)
+
+// defaults used unless set with WithPublishConcurrency or WithPublishRetry
+const (
+	defaultPublishConcurrency = 4
+	defaultPublishAttempts    = 3
+	defaultPublishBackoff     = time.Second
+)
+
+// PublishResult describes an image published to a registry.
+type PublishResult struct {
+	// Name of the image added with WithImage, empty for the default image.
+	Image string
+	// Published image reference, including the tag.
+	Ref string
+	// Digest of the manifest list, or of the image manifest if a single platform was published.
+	Digest string
+	// Manifest of each published platform.
+	Platforms []*PlatformManifest
+	// Total size in bytes of the configs and layers of all platforms.
+	Size int
+	// SBOM and provenance attestations attached to each platform, if enabled.
+	Attestations *dagger.Directory
+}
+
+// PlatformManifest describes the image manifest of a single platform.
+type PlatformManifest struct {
+	Platform dagger.Platform
+	// Digest of the image manifest.
+	Digest string
+	// Size in bytes of the image config and layers.
+	Size int
+}
+
+// Returns the image reference pinned to its digest, e.g. registry/repo:tag@sha256:...
+func (r *PublishResult) PinnedRef() string {
+	return r.Ref + "@" + r.Digest
+}
+
+// ociDescriptor is the subset of an OCI content descriptor used by this module.
+type ociDescriptor struct {
+	MediaType    string            `json:"mediaType"`
+	ArtifactType string            `json:"artifactType,omitempty"`
+	Digest       string            `json:"digest"`
+	Size         int               `json:"size"`
+	Platform     *ociPlatform      `json:"platform,omitempty"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+}
+
+type ociPlatform struct {
+	OS           string `json:"os"`
+	Architecture string `json:"architecture"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+func (p *ociPlatform) String() string {
+	s := p.OS + "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	return s
+}
+
+// ociManifest is the subset of an OCI image manifest or image index used by this module.
+type ociManifest struct {
+	MediaType   string            `json:"mediaType"`
+	Config      *ociDescriptor    `json:"config,omitempty"`
+	Layers      []ociDescriptor   `json:"layers,omitempty"`
+	Manifests   []ociDescriptor   `json:"manifests,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// isIndex reports whether the manifest is an image index (manifest list).
+func (m *ociManifest) isIndex() bool {
+	return len(m.Manifests) > 0
+}
+
+// size returns the total size of the config and layers of an image manifest.
+func (m *ociManifest) size() int {
+	var size int
+	if m.Config != nil {
+		size += m.Config.Size
+	}
+	for _, l := range m.Layers {
+		size += l.Size
+	}
+	return size
+}
+
+// publish pushes the platform variants of an image to every address added with WithPublish,
+// then attests and signs them.
+//
+// Tags that were published are attested and signed even if others failed, so a partial publish
+// can be finished with Promote.
+func (docker *Docker) publish(ctx context.Context, pushes *semaphore.Weighted, img Image, platformVariants []*dagger.Container) ([]*PublishResult, error) {
+	started := time.Now().UTC()
+
+	// registries bound with WithRegistryService are not reachable from the engine, only from the
+	// tools container, so the image is pushed from an OCI layout with crane instead
+	layout := docker.tools().
+		WithMountedFile(archivePath, dag.Container().AsTarball(dagger.ContainerAsTarballOpts{
+			PlatformVariants: platformVariants,
+			MediaTypes:       dagger.ImageMediaTypesOcimediaTypes,
+		})).
+		WithExec([]string{"mkdir", "-p", layoutPath}).
+		WithExec([]string{"tar", "-xf", archivePath, "-C", layoutPath})
+
+	results, pubErr := docker.publishRefs(ctx, pushes, docker.imageRefs(img.Name), func(ref string) (string, error) {
+		if insecure := docker.insecureFlag(ref, "--insecure"); len(insecure) > 0 {
+			args := slices.Concat([]string{"crane", "push", layoutPath, ref}, insecure)
+			out, err := layout.WithExec(args).Stdout(ctx)
+			if err != nil {
+				return "", err
+			}
+			// crane prints the repository pinned to the digest, without the tag
+			if _, digest, ok := strings.Cut(strings.TrimSpace(out), "@"); ok {
+				return ref + "@" + digest, nil
+			}
+			return ref, nil
+		}
+
+		return dag.Container().Publish(ctx, ref, dagger.ContainerPublishOpts{
+			PlatformVariants: platformVariants,
+		})
+	})
+	for _, result := range results {
+		result.Image = img.Name
+	}
+
+	if err := docker.attest(ctx, img.Target, platformVariants, results, started); err != nil {
+		return nil, errors.Join(pubErr, err)
+	}
+	if err := docker.signResults(ctx, results); err != nil {
+		return nil, errors.Join(pubErr, err)
+	}
+	if pubErr != nil {
+		return nil, pubErr
+	}
+
+	return results, nil
+}
+
+// publishRefs pushes to each reference in parallel, limited by pushes, and retried on transient
+// errors as configured with WithPublishRetry. push returns the published reference
+// in the form registry/repo:tag@sha256:..., or without the digest to resolve it from the registry.
+//
+// Every reference is attempted even if others fail. The references that were published are
+// returned either way, with a publishError reporting which failed.
+func (docker *Docker) publishRefs(ctx context.Context, pushes *semaphore.Weighted, refs []string, push func(ref string) (string, error)) ([]*PublishResult, error) {
+	results := make([]*PublishResult, len(refs))
+	errs := make([]error, len(refs))
+
+	var g errgroup.Group
+	for i, ref := range refs {
+		g.Go(func() error {
+			if err := pushes.Acquire(ctx, 1); err != nil {
+				errs[i] = fmt.Errorf("publishing %s: %w", ref, err)
+				return nil
+			}
+			defer pushes.Release(1)
+
+			var published string
+			err := docker.retry(ctx, func() error {
+				var err error
+				published, err = push(ref)
+				return err
+			})
+			if err != nil {
+				errs[i] = fmt.Errorf("publishing %s: %w", ref, err)
+				return nil
+			}
+
+			// resolving and inspecting are retried separately, so the image is not pushed again
+			if !strings.Contains(published, "@") {
+				err = docker.retry(ctx, func() error {
+					digest, err := docker.digest(ctx, published)
+					if err != nil {
+						return err
+					}
+					published += "@" + digest
+					return nil
+				})
+				if err != nil {
+					errs[i] = fmt.Errorf("resolving digest of %s: %w", ref, err)
+					return nil
+				}
+			}
+
+			errs[i] = docker.retry(ctx, func() error {
+				var err error
+				results[i], err = docker.inspect(ctx, published)
+				return err
+			})
+			return nil
+		})
+	}
+	_ = g.Wait()
+
+	perr := &publishError{failed: make(map[string]error)}
+	for i, ref := range refs {
+		if errs[i] != nil {
+			perr.failed[ref] = errs[i]
+		} else {
+			perr.published = append(perr.published, results[i])
+		}
+	}
+	if len(perr.failed) > 0 {
+		return perr.published, perr
+	}
+	return results, nil
+}
+
+// digest returns the digest of a published reference.
+func (docker *Docker) digest(ctx context.Context, ref string) (string, error) {
+	args := append([]string{"crane", "digest", ref}, docker.insecureFlag(ref, "--insecure")...)
+	out, err := docker.tools().WithExec(args).Stdout(ctx)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// publishError reports which references were published when publishing to others failed,
+// so a partial publish can be finished without rebuilding.
+type publishError struct {
+	published []*PublishResult
+	failed    map[string]error
+}
+
+func (e *publishError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "published %d of %d tags", len(e.published), len(e.published)+len(e.failed))
+	for _, result := range e.published {
+		fmt.Fprintf(&b, "\nsucceeded: %s", result.PinnedRef())
+	}
+	for _, ref := range slices.Sorted(maps.Keys(e.failed)) {
+		fmt.Fprintf(&b, "\nfailed: %s: %v", ref, e.failed[ref])
+	}
+	if len(e.published) > 0 {
+		fmt.Fprintf(&b, "\nfinish publishing without rebuilding with Promote from %s", e.published[0].PinnedRef())
+	}
+	return b.String()
+}
+
+func (e *publishError) Unwrap() []error {
+	return slices.Collect(maps.Values(e.failed))
+}
+
+// retry calls fn until it succeeds, fails with an error that is not transient, the attempts
+// added with WithPublishRetry are exhausted, or ctx is cancelled.
+func (docker *Docker) retry(ctx context.Context, fn func() error) error {
+	attempts, backoff := docker.publishRetry()
+	for attempt := 1; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		err := fn()
+		if err == nil || attempt >= attempts || !transient(err) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return errors.Join(err, ctx.Err())
+		case <-time.After(backoff << (attempt - 1)):
+		}
+	}
+}
+
+// transientErrors are substrings of registry errors that may succeed when retried.
+var transientErrors = []string{
+	"toomanyrequests",
+	"too many requests",
+	"internal server error",
+	"bad gateway",
+	"service unavailable",
+	"gateway timeout",
+	"timeout",
+	"connection reset",
+	"connection refused",
+	"broken pipe",
+	"unexpected eof",
+}
+
+// transient reports whether a registry error may succeed when retried.
+func transient(err error) bool {
+	msg := strings.ToLower(err.Error())
+	for _, s := range transientErrors {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// pushLimit returns a limiter for the number of tags published at once, as added with
+// WithPublishConcurrency or the default. A single limiter is shared by every image published
+// by a call.
+func (docker *Docker) pushLimit() *semaphore.Weighted {
+	limit := docker.PublishConcurrency
+	if limit == 0 {
+		limit = defaultPublishConcurrency
+	}
+	return semaphore.NewWeighted(int64(limit))
+}
+
+// publishRetry returns the attempts and backoff added with WithPublishRetry, or the defaults.
+func (docker *Docker) publishRetry() (int, time.Duration) {
+	if docker.PublishAttempts == 0 {
+		return defaultPublishAttempts, defaultPublishBackoff
+	}
+	// validated by WithPublishRetry
+	backoff, _ := time.ParseDuration(docker.PublishBackoff)
+	return docker.PublishAttempts, backoff
+}
+
+// inspect fetches the manifests of a published image reference, in the form returned by
+// Container.Publish: registry/repo:tag@sha256:...
+func (docker *Docker) inspect(ctx context.Context, published string) (*PublishResult, error) {
+	ref, digest, ok := strings.Cut(published, "@")
+	if !ok {
+		return nil, fmt.Errorf("published reference %q has no digest", published)
+	}
+
+	result := &PublishResult{
+		Ref:    ref,
+		Digest: digest,
+	}
+
+	crane := docker.tools()
+	repo := repository(ref)
+
+	root, err := docker.fetchManifest(ctx, crane, repo+"@"+digest)
+	if err != nil {
+		return nil, err
+	}
+
+	if !root.isIndex() {
+		// a single platform is published as an image manifest
+		var config ociPlatform
+		args := append([]string{"crane", "config", repo + "@" + digest}, docker.insecureFlag(ref, "--insecure")...)
+		out, err := crane.WithExec(args).Stdout(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("fetching config of %s: %w", published, err)
+		}
+		if err := json.Unmarshal([]byte(out), &config); err != nil {
+			return nil, fmt.Errorf("parsing config of %s: %w", published, err)
+		}
+
+		result.Size = root.size()
+		result.Platforms = []*PlatformManifest{{
+			Platform: dagger.Platform(config.String()),
+			Digest:   digest,
+			Size:     result.Size,
+		}}
+		return result, nil
+	}
+
+	for _, desc := range root.Manifests {
+		if desc.Platform == nil || desc.Platform.OS == "unknown" {
+			// attestation manifests are not platform variants
+			continue
+		}
+
+		m, err := docker.fetchManifest(ctx, crane, repo+"@"+desc.Digest)
+		if err != nil {
+			return nil, err
+		}
+
+		result.Size += m.size()
+		result.Platforms = append(result.Platforms, &PlatformManifest{
+			Platform: dagger.Platform(desc.Platform.String()),
+			Digest:   desc.Digest,
+			Size:     m.size(),
+		})
+	}
+
+	return result, nil
+}
+
+// fetchManifest fetches and parses the manifest of an image reference using crane.
+func (docker *Docker) fetchManifest(ctx context.Context, crane *dagger.Container, ref string) (*ociManifest, error) {
+	args := append([]string{"crane", "manifest", ref}, docker.insecureFlag(ref, "--insecure")...)
+	out, err := crane.WithExec(args).Stdout(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("fetching manifest of %s: %w", ref, err)
+	}
+
+	var m ociManifest
+	if err := json.Unmarshal([]byte(out), &m); err != nil {
+		return nil, fmt.Errorf("parsing manifest of %s: %w", ref, err)
+	}
+	return &m, nil
+}
+
+// repository strips the tag and digest from an image reference.
+func repository(ref string) string {
+	ref, _, _ = strings.Cut(ref, "@")
+	// a colon after the last slash separates the tag, otherwise it is a registry port
+	if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+		ref = ref[:i]
+	}
+	return ref
+}
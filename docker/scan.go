@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"dagger/docker/internal/dagger"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// trivy severities, from least to most severe
+var severities = []string{"UNKNOWN", "LOW", "MEDIUM", "HIGH", "CRITICAL"}
+
+const trivyCacheDir = "/root/.cache/trivy"
+
+// Scan images for vulnerabilities before publishing, failing Build when any reach the severity.
+func (m *Docker) WithScan(
+	// minimum severity that fails the build. Supported values: 'UNKNOWN', 'LOW', 'MEDIUM', 'HIGH', or 'CRITICAL'.
+	// +optional
+	// +default="HIGH"
+	severity string,
+	// trivy cache directory containing an offline vulnerability database, for air-gapped use
+	// +optional
+	db *dagger.Directory,
+) (*Docker, error) {
+	severity = strings.ToUpper(severity)
+	if !slices.Contains(severities, severity) {
+		return nil, fmt.Errorf("unsupported severity %q, expected one of %s", severity, strings.Join(severities, ", "))
+	}
+	m.ScanSeverity = severity
+	m.ScanDB = db
+	return m, nil
+}
+
+// Scan each platform variant for vulnerabilities with trivy, returning JSON and SARIF reports for each platform.
+//
+// Fails if any vulnerability reaches the severity, unless noFail is set, in which case they are listed
+// in failures.txt next to the reports.
+//
+// e.g. `trivy image --input <image> --format json`.
+func (m *Docker) Scan(ctx context.Context,
+	// target stage of image build
+	// +optional
+	// +default="ci"
+	target string,
+	// platforms to build with. value of [os]/[arch]/[variant], example: linux/amd64, linux/arm/v7. Defaults to platforms added with WithPlatformMatrix, or linux/amd64.
+	// +optional
+	platforms []dagger.Platform,
+	// minimum severity that fails the scan, reports are returned without failing if unset. Supported values: 'UNKNOWN', 'LOW', 'MEDIUM', 'HIGH', or 'CRITICAL'.
+	// +optional
+	severity string,
+	// trivy cache directory containing an offline vulnerability database, for air-gapped use
+	// +optional
+	db *dagger.Directory,
+	// return reports without failing, listing vulnerabilities at or above the severity in failures.txt
+	// +optional
+	noFail bool,
+	// name of an image added with WithImage, required if any were added
+	// +optional
+	image string,
+) (*dagger.Directory, error) {
+	platforms = m.platforms(platforms)
+	severity = strings.ToUpper(severity)
+
+	img, err := m.image(image, target)
+	if err != nil {
+		return nil, err
+	}
+
+	platformVariants, err := m.variants(ctx, img, platforms)
+	if err != nil {
+		return nil, err
+	}
+
+	reports, vulns, err := m.scan(ctx, platforms, platformVariants, severity, db)
+	switch {
+	case err != nil:
+		return nil, err
+	case len(vulns) == 0:
+		return reports, nil
+	case noFail:
+		return withFailures(reports, vulns), nil
+	}
+	return nil, fmt.Errorf("vulnerabilities at or above %s found:\n%w", severity, errors.Join(vulns...))
+}
+
+// scanGate scans the variants if enabled with WithScan, before they are published.
+func (docker *Docker) scanGate(ctx context.Context, platforms []dagger.Platform, platformVariants []*dagger.Container) error {
+	if docker.ScanSeverity == "" {
+		return nil
+	}
+	_, vulns, err := docker.scan(ctx, platforms, platformVariants, docker.ScanSeverity, docker.ScanDB)
+	if err != nil {
+		return err
+	}
+	if len(vulns) > 0 {
+		return fmt.Errorf("vulnerabilities at or above %s found:\n%w", docker.ScanSeverity, errors.Join(vulns...))
+	}
+	return nil
+}
+
+// trivyReport is the subset of the trivy JSON report used to enforce a severity threshold.
+type trivyReport struct {
+	Results []struct {
+		Target          string `json:"Target"`
+		Vulnerabilities []struct {
+			VulnerabilityID string `json:"VulnerabilityID"`
+			PkgName         string `json:"PkgName"`
+			Severity        string `json:"Severity"`
+		} `json:"Vulnerabilities"`
+	} `json:"Results"`
+}
+
+// scan runs trivy against each variant, returning the reports and, if severity is set, the vulnerabilities reaching it.
+func (docker *Docker) scan(ctx context.Context,
+	platforms []dagger.Platform,
+	platformVariants []*dagger.Container,
+	severity string,
+	db *dagger.Directory,
+) (*dagger.Directory, []error, error) {
+	threshold := slices.Index(severities, severity)
+	if severity != "" && threshold < 0 {
+		return nil, nil, fmt.Errorf("unsupported severity %q, expected one of %s", severity, strings.Join(severities, ", "))
+	}
+
+	trivy := docker.tools("trivy").
+		WithWorkdir("/work").
+		With(func(c *dagger.Container) *dagger.Container {
+			if db != nil {
+				return c.WithMountedDirectory(trivyCacheDir, db)
+			}
+			return c.WithMountedCache(trivyCacheDir, dag.CacheVolume("trivy"))
+		})
+
+	args := []string{"trivy", "image",
+		"--cache-dir", trivyCacheDir,
+		"--input", "image.tar",
+		"--format", "json",
+		"--output", "trivy.json",
+	}
+	if db != nil {
+		args = append(args, "--skip-db-update", "--skip-java-db-update", "--offline-scan")
+	}
+
+	reports := dag.Directory()
+	var vulns []error
+	for i, ctr := range platformVariants {
+		scanned := trivy.
+			WithMountedFile("image.tar", ctr.AsTarball()).
+			WithExec(args).
+			WithExec([]string{"trivy", "convert",
+				"--format", "sarif",
+				"--output", "trivy.sarif",
+				"trivy.json",
+			})
+
+		out, err := scanned.File("trivy.json").Contents(ctx)
+		if err != nil {
+			return nil, nil, fmt.Errorf("scanning platform %s: %w", platforms[i], err)
+		}
+
+		reports = reports.
+			WithFile(platformDir(platforms[i])+"/trivy.json", scanned.File("trivy.json")).
+			WithFile(platformDir(platforms[i])+"/trivy.sarif", scanned.File("trivy.sarif"))
+
+		if severity == "" {
+			continue
+		}
+
+		var report trivyReport
+		if err := json.Unmarshal([]byte(out), &report); err != nil {
+			return nil, nil, fmt.Errorf("parsing trivy report of platform %s: %w", platforms[i], err)
+		}
+		for _, result := range report.Results {
+			for _, vuln := range result.Vulnerabilities {
+				if slices.Index(severities, vuln.Severity) >= threshold {
+					vulns = append(vulns, fmt.Errorf("platform %s: %s %s in %s (%s)",
+						platforms[i], vuln.Severity, vuln.VulnerabilityID, vuln.PkgName, result.Target))
+				}
+			}
+		}
+	}
+
+	return reports, vulns, nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"dagger/docker/internal/dagger"
+	"fmt"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// secretMountRegexp matches the options of a `RUN --mount=type=secret,...` flag.
+var secretMountRegexp = regexp.MustCompile(`--mount=(\S*type=secret\S*)`)
+
+// buildSecrets returns the secrets added with WithSecret, checking that every required build secret
+// referenced by the Dockerfile was provided.
+//
+// The engine mounts a build secret under its secret name, so it is only used when every secret
+// name matches its build secret ID, see renamedSecrets.
+func (docker *Docker) buildSecrets(ctx context.Context, dockerfile string) ([]*dagger.Secret, error) {
+	if err := docker.checkSecrets(ctx, dockerfile); err != nil {
+		return nil, err
+	}
+
+	secrets := make([]*dagger.Secret, 0, len(docker.Secrets))
+	for _, s := range docker.Secrets {
+		secrets = append(secrets, s.Value)
+	}
+	return secrets, nil
+}
+
+// renamedSecrets reports whether any secret added with WithSecret has a name other than its build
+// secret ID. The engine offers no way to rename a secret without reading it, so such builds are run
+// with buildkit, which mounts secrets by ID without reading them.
+func (docker *Docker) renamedSecrets(ctx context.Context) (bool, error) {
+	for _, s := range docker.Secrets {
+		name, err := s.Value.Name(ctx)
+		if err != nil {
+			return false, fmt.Errorf("failed to get the name of secret %s: %w", s.Name, err)
+		}
+		if name != s.Name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// checkSecrets checks that every required build secret referenced by the Dockerfile was provided with
+// WithSecret. As with BuildKit, secret mounts are optional unless they set required.
+func (docker *Docker) checkSecrets(ctx context.Context, dockerfile string) error {
+	contents, err := docker.Source.File(dockerfile).Contents(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", dockerfile, err)
+	}
+
+	provided := make([]string, 0, len(docker.Secrets))
+	for _, s := range docker.Secrets {
+		provided = append(provided, s.Name)
+	}
+
+	var missing []string
+	for _, id := range requiredSecretIDs(contents) {
+		if !slices.Contains(provided, id) {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%s references build secrets that were not provided with WithSecret: %s",
+			dockerfile, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// requiredSecretIDs returns the IDs of the required build secrets mounted by a Dockerfile, in order of
+// first use. Commented out lines are ignored.
+func requiredSecretIDs(dockerfile string) []string {
+	var lines []string
+	for _, line := range strings.Split(dockerfile, "\n") {
+		if !strings.HasPrefix(strings.TrimSpace(line), "#") {
+			lines = append(lines, line)
+		}
+	}
+
+	var ids []string
+	for _, match := range secretMountRegexp.FindAllStringSubmatch(strings.Join(lines, "\n"), -1) {
+		var id, target string
+		var required bool
+		for _, opt := range strings.Split(match[1], ",") {
+			key, value, hasValue := strings.Cut(opt, "=")
+			switch key {
+			case "id":
+				id = value
+			case "target", "dst", "destination":
+				target = value
+			case "required":
+				required = !hasValue || value == "true"
+			}
+		}
+		if !required {
+			continue
+		}
+		// BuildKit defaults the ID to the base name of the target
+		if id == "" && target != "" {
+			id = path.Base(target)
+		}
+		if id != "" && !slices.Contains(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
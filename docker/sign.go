@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"dagger/docker/internal/dagger"
+	"fmt"
+)
+
+const (
+	cosignKeyPath       = "/run/secrets/cosign.key"
+	cosignPublicKeyPath = "/work/cosign.pub"
+)
+
+// Sign published images with a cosign private key.
+//
+// Signatures are stored in the registry in cosign's format, for the manifest list and each platform manifest.
+func (m *Docker) WithSigningKey(
+	// cosign private key
+	key *dagger.Secret,
+	// password of the private key
+	// +optional
+	password *dagger.Secret,
+) *Docker {
+	m.SigningKey = key
+	m.SigningPassword = password
+	return m
+}
+
+// Sign an image with a cosign private key.
+//
+// Signs the manifest list and each platform manifest, storing signatures in the registry.
+// Transparency log upload is disabled.
+//
+// e.g. `cosign sign --key <key> --recursive --tlog-upload=false <ref>`.
+func (m *Docker) Sign(ctx context.Context,
+	// image reference, preferably pinned by digest
+	ref string,
+	// cosign private key
+	key *dagger.Secret,
+	// password of the private key
+	// +optional
+	password *dagger.Secret,
+) error {
+	args := []string{"cosign", "sign",
+		"--key", cosignKeyPath,
+		"--recursive",
+		"--tlog-upload=false",
+		"--yes",
+	}
+	args = append(args, m.insecureFlag(ref, "--allow-insecure-registry")...)
+
+	_, err := m.tools("cosign").
+		WithMountedSecret(cosignKeyPath, key).
+		With(func(c *dagger.Container) *dagger.Container {
+			if password != nil {
+				return c.WithSecretVariable("COSIGN_PASSWORD", password)
+			}
+			return c.WithEnvVariable("COSIGN_PASSWORD", "")
+		}).
+		WithExec(append(args, ref)).
+		Sync(ctx)
+	if err != nil {
+		return fmt.Errorf("signing %s: %w", ref, err)
+	}
+	return nil
+}
+
+// Verify the cosign signature of an image against a public key, returning the verified signature payloads.
+//
+// Transparency log verification is skipped, matching Sign.
+//
+// e.g. `cosign verify --key <key> --insecure-ignore-tlog <ref>`.
+func (m *Docker) Verify(ctx context.Context,
+	// image reference
+	ref string,
+	// cosign public key
+	key *dagger.File,
+) (string, error) {
+	args := []string{"cosign", "verify",
+		"--key", cosignPublicKeyPath,
+		"--insecure-ignore-tlog",
+	}
+	args = append(args, m.insecureFlag(ref, "--allow-insecure-registry")...)
+
+	out, err := m.tools("cosign").
+		WithMountedFile(cosignPublicKeyPath, key).
+		WithExec(append(args, ref)).
+		Stdout(ctx)
+	if err != nil {
+		return "", fmt.Errorf("verifying %s: %w", ref, err)
+	}
+	return out, nil
+}
+
+// signResults signs each published digest if a signing key was added with WithSigningKey.
+func (docker *Docker) signResults(ctx context.Context, results []*PublishResult) error {
+	if docker.SigningKey == nil {
+		return nil
+	}
+
+	// tags of the same build share a digest, so each is only signed once per repository,
+	// where cosign stores its signatures
+	signed := make(map[string]bool)
+	for _, result := range results {
+		ref := repository(result.Ref) + "@" + result.Digest
+		if signed[ref] {
+			continue
+		}
+		if err := docker.Sign(ctx, ref, docker.SigningKey, docker.SigningPassword); err != nil {
+			return err
+		}
+		signed[ref] = true
+	}
+	return nil
+}
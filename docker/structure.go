@@ -0,0 +1,426 @@
+package main
+
+import (
+	"context"
+	"dagger/docker/internal/dagger"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// structureSpec is a container-structure-test configuration, see
+// https://github.com/GoogleContainerTools/container-structure-test.
+type structureSpec struct {
+	// accepted, but not checked
+	SchemaVersion      string              `json:"schemaVersion"`
+	CommandTests       []commandTest       `json:"commandTests"`
+	FileExistenceTests []fileExistenceTest `json:"fileExistenceTests"`
+	FileContentTests   []fileContentTest   `json:"fileContentTests"`
+	MetadataTest       *metadataTest       `json:"metadataTest"`
+}
+
+type keyValue struct {
+	Key     string `json:"key"`
+	Value   string `json:"value"`
+	IsRegex bool   `json:"isRegex"`
+}
+
+type commandTest struct {
+	Name           string     `json:"name"`
+	Command        string     `json:"command"`
+	Args           []string   `json:"args"`
+	EnvVars        []keyValue `json:"envVars"`
+	ExpectedOutput []string   `json:"expectedOutput"`
+	ExcludedOutput []string   `json:"excludedOutput"`
+	ExpectedError  []string   `json:"expectedError"`
+	ExcludedError  []string   `json:"excludedError"`
+	ExitCode       int        `json:"exitCode"`
+}
+
+type fileExistenceTest struct {
+	Name        string `json:"name"`
+	Path        string `json:"path"`
+	ShouldExist bool   `json:"shouldExist"`
+}
+
+type fileContentTest struct {
+	Name             string   `json:"name"`
+	Path             string   `json:"path"`
+	ExpectedContents []string `json:"expectedContents"`
+	ExcludedContents []string `json:"excludedContents"`
+}
+
+type metadataTest struct {
+	EnvVars        []keyValue `json:"envVars"`
+	Labels         []keyValue `json:"labels"`
+	Entrypoint     *[]string  `json:"entrypoint"`
+	Cmd            *[]string  `json:"cmd"`
+	ExposedPorts   []string   `json:"exposedPorts"`
+	UnexposedPorts []string   `json:"unexposedPorts"`
+	Workdir        string     `json:"workdir"`
+	User           string     `json:"user"`
+}
+
+// structureResult is the outcome of a single assertion.
+type structureResult struct {
+	Name     string
+	Failures []string
+}
+
+// Run container-structure-test style assertions against each platform variant, returning a JUnit report for each platform.
+//
+// Supported assertions are commandTests, fileExistenceTests (shouldExist only), fileContentTests,
+// and metadataTest (envVars, labels, entrypoint, cmd, exposedPorts, unexposedPorts, workdir, and user).
+// Any other field, e.g. permissions, uid, or setup, fails the spec rather than being ignored.
+// Run against each target that must meet the assertions, e.g. the ci and release targets.
+//
+// Fails if any assertion fails, unless noFail is set, in which case failures are listed in failures.txt
+// next to the reports.
+func (m *Docker) Test(ctx context.Context,
+	// container-structure-test YAML spec
+	spec *dagger.File,
+	// target stage of image build
+	// +optional
+	// +default="ci"
+	target string,
+	// platforms to build with. value of [os]/[arch]/[variant], example: linux/amd64, linux/arm/v7. Defaults to platforms added with WithPlatformMatrix, or linux/amd64.
+	// +optional
+	platforms []dagger.Platform,
+	// return reports without failing, listing failures in failures.txt
+	// +optional
+	noFail bool,
+	// name of an image added with WithImage, required if any were added
+	// +optional
+	image string,
+) (*dagger.Directory, error) {
+	platforms = m.platforms(platforms)
+
+	img, err := m.image(image, target)
+	if err != nil {
+		return nil, err
+	}
+
+	// the spec is converted to JSON, which the module can parse without a YAML dependency
+	specJSON, err := m.tools("yq").
+		WithMountedFile("/work/spec.yaml", spec).
+		WithExec([]string{"yq", "--output-format=json", "/work/spec.yaml"}).
+		Stdout(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("reading structure test spec: %w", err)
+	}
+
+	// unsupported assertions, e.g. permissions or uid, fail rather than silently passing
+	var s structureSpec
+	dec := json.NewDecoder(strings.NewReader(specJSON))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&s); err != nil {
+		return nil, fmt.Errorf("parsing structure test spec, only supported assertions are allowed: %w", err)
+	}
+
+	platformVariants, err := m.variants(ctx, img, platforms)
+	if err != nil {
+		return nil, err
+	}
+
+	reports := dag.Directory()
+	var errs []error
+	for i, ctr := range platformVariants {
+		results, err := s.run(ctx, ctr)
+		if err != nil {
+			return nil, fmt.Errorf("testing platform %s: %w", platforms[i], err)
+		}
+
+		report, err := junitReport(fmt.Sprintf("%s (%s)", target, platforms[i]), results)
+		if err != nil {
+			return nil, err
+		}
+		reports = reports.WithNewFile(platformDir(platforms[i])+"/junit.xml", report)
+
+		for _, r := range results {
+			for _, f := range r.Failures {
+				errs = append(errs, fmt.Errorf("platform %s: %s: %s", platforms[i], r.Name, f))
+			}
+		}
+	}
+
+	if len(errs) == 0 {
+		return reports, nil
+	}
+	if noFail {
+		return withFailures(reports, errs), nil
+	}
+	return nil, fmt.Errorf("structure tests of target %q failed:\n%w", target, errors.Join(errs...))
+}
+
+// run evaluates every assertion of the spec against a container.
+func (s *structureSpec) run(ctx context.Context, ctr *dagger.Container) ([]structureResult, error) {
+	var results []structureResult
+
+	for _, t := range s.CommandTests {
+		r := structureResult{Name: t.Name}
+		c := ctr
+		for _, env := range t.EnvVars {
+			c = c.WithEnvVariable(env.Key, env.Value)
+		}
+		c = c.WithExec(append([]string{t.Command}, t.Args...), dagger.ContainerWithExecOpts{
+			Expect: dagger.ReturnTypeAny,
+		})
+
+		code, err := c.ExitCode(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("running %s: %w", t.Name, err)
+		}
+		stdout, err := c.Stdout(ctx)
+		if err != nil {
+			return nil, err
+		}
+		stderr, err := c.Stderr(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		if code != t.ExitCode {
+			r.fail("expected exit code %d, got %d", t.ExitCode, code)
+		}
+		r.matchAll("output", stdout, t.ExpectedOutput, true)
+		r.matchAll("output", stdout, t.ExcludedOutput, false)
+		r.matchAll("error", stderr, t.ExpectedError, true)
+		r.matchAll("error", stderr, t.ExcludedError, false)
+		results = append(results, r)
+	}
+
+	rootfs := ctr.Rootfs()
+	for _, t := range s.FileExistenceTests {
+		r := structureResult{Name: t.Name}
+		matches, err := rootfs.Glob(ctx, strings.TrimPrefix(t.Path, "/"))
+		if err != nil {
+			return nil, fmt.Errorf("checking %s: %w", t.Path, err)
+		}
+		if exists := len(matches) > 0; exists != t.ShouldExist {
+			r.fail("expected %s to exist: %t", t.Path, t.ShouldExist)
+		}
+		results = append(results, r)
+	}
+
+	for _, t := range s.FileContentTests {
+		r := structureResult{Name: t.Name}
+		contents, err := ctr.File(t.Path).Contents(ctx)
+		if err != nil {
+			r.fail("reading %s: %s", t.Path, err)
+		} else {
+			r.matchAll("contents", contents, t.ExpectedContents, true)
+			r.matchAll("contents", contents, t.ExcludedContents, false)
+		}
+		results = append(results, r)
+	}
+
+	if s.MetadataTest != nil {
+		r, err := s.MetadataTest.run(ctx, ctr)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, r)
+	}
+
+	return results, nil
+}
+
+// run evaluates the metadata assertions against the config of a container.
+func (t *metadataTest) run(ctx context.Context, ctr *dagger.Container) (structureResult, error) {
+	r := structureResult{Name: "Metadata Test"}
+
+	if len(t.EnvVars) > 0 {
+		vars, err := ctr.EnvVariables(ctx)
+		if err != nil {
+			return r, err
+		}
+		env := make(map[string]string, len(vars))
+		for _, v := range vars {
+			name, err := v.Name(ctx)
+			if err != nil {
+				return r, err
+			}
+			env[name], err = v.Value(ctx)
+			if err != nil {
+				return r, err
+			}
+		}
+		r.matchKeyValues("env var", env, t.EnvVars)
+	}
+
+	if len(t.Labels) > 0 {
+		labels, err := ctr.Labels(ctx)
+		if err != nil {
+			return r, err
+		}
+		values := make(map[string]string, len(labels))
+		for _, l := range labels {
+			name, err := l.Name(ctx)
+			if err != nil {
+				return r, err
+			}
+			values[name], err = l.Value(ctx)
+			if err != nil {
+				return r, err
+			}
+		}
+		r.matchKeyValues("label", values, t.Labels)
+	}
+
+	if t.Entrypoint != nil {
+		entrypoint, err := ctr.Entrypoint(ctx)
+		if err != nil {
+			return r, err
+		}
+		if !slices.Equal(entrypoint, *t.Entrypoint) {
+			r.fail("expected entrypoint %q, got %q", *t.Entrypoint, entrypoint)
+		}
+	}
+
+	if t.Cmd != nil {
+		cmd, err := ctr.DefaultArgs(ctx)
+		if err != nil {
+			return r, err
+		}
+		if !slices.Equal(cmd, *t.Cmd) {
+			r.fail("expected cmd %q, got %q", *t.Cmd, cmd)
+		}
+	}
+
+	if len(t.ExposedPorts) > 0 || len(t.UnexposedPorts) > 0 {
+		ports, err := ctr.ExposedPorts(ctx)
+		if err != nil {
+			return r, err
+		}
+		var exposed []string
+		for _, p := range ports {
+			port, err := p.Port(ctx)
+			if err != nil {
+				return r, err
+			}
+			exposed = append(exposed, strconv.Itoa(port))
+		}
+		for _, p := range t.ExposedPorts {
+			if !slices.Contains(exposed, p) {
+				r.fail("expected port %s to be exposed", p)
+			}
+		}
+		for _, p := range t.UnexposedPorts {
+			if slices.Contains(exposed, p) {
+				r.fail("expected port %s not to be exposed", p)
+			}
+		}
+	}
+
+	if t.Workdir != "" {
+		workdir, err := ctr.Workdir(ctx)
+		if err != nil {
+			return r, err
+		}
+		if workdir != t.Workdir {
+			r.fail("expected workdir %q, got %q", t.Workdir, workdir)
+		}
+	}
+
+	if t.User != "" {
+		user, err := ctr.User(ctx)
+		if err != nil {
+			return r, err
+		}
+		if user != t.User {
+			r.fail("expected user %q, got %q", t.User, user)
+		}
+	}
+
+	return r, nil
+}
+
+func (r *structureResult) fail(format string, a ...any) {
+	r.Failures = append(r.Failures, fmt.Sprintf(format, a...))
+}
+
+// matchAll checks that every regular expression matches s if expected, or that none do otherwise.
+func (r *structureResult) matchAll(what, s string, patterns []string, expected bool) {
+	for _, pattern := range patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			r.fail("invalid regular expression %q: %s", pattern, err)
+			continue
+		}
+		if re.MatchString(s) != expected {
+			if expected {
+				r.fail("expected %s to match %q", what, pattern)
+			} else {
+				r.fail("expected %s not to match %q", what, pattern)
+			}
+		}
+	}
+}
+
+// matchKeyValues checks expected key values, such as env vars or labels.
+func (r *structureResult) matchKeyValues(what string, actual map[string]string, expected []keyValue) {
+	for _, kv := range expected {
+		value, ok := actual[kv.Key]
+		switch {
+		case !ok:
+			r.fail("expected %s %s to be set", what, kv.Key)
+		case kv.IsRegex:
+			r.matchAll(what+" "+kv.Key, value, []string{kv.Value}, true)
+		case value != kv.Value:
+			r.fail("expected %s %s to be %q, got %q", what, kv.Key, kv.Value, value)
+		}
+	}
+}
+
+// failuresFile lists failures next to reports returned without failing.
+const failuresFile = "failures.txt"
+
+// withFailures adds a list of failures to reports, one per line.
+func withFailures(reports *dagger.Directory, errs []error) *dagger.Directory {
+	return reports.WithNewFile(failuresFile, errors.Join(errs...).Error()+"\n")
+}
+
+type junitTestSuite struct {
+	XMLName   xml.Name        `xml:"testsuite"`
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	TestCases []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name    string        `xml:"name,attr"`
+	Failure *junitFailure `xml:"failure,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// junitReport encodes structure test results as a JUnit XML test suite.
+func junitReport(name string, results []structureResult) (string, error) {
+	suite := junitTestSuite{Name: name, Tests: len(results)}
+	for _, r := range results {
+		tc := junitTestCase{Name: r.Name}
+		if len(r.Failures) > 0 {
+			suite.Failures++
+			tc.Failure = &junitFailure{
+				Message: r.Failures[0],
+				Text:    strings.Join(r.Failures, "\n"),
+			}
+		}
+		suite.TestCases = append(suite.TestCases, tc)
+	}
+
+	b, err := xml.MarshalIndent(suite, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("encoding junit report: %w", err)
+	}
+	return xml.Header + string(b) + "\n", nil
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var (
+	// semverRegexp matches a semantic version, with an optional "v" prefix
+	semverRegexp = regexp.MustCompile(`^v?(0|[1-9]\d*)\.(0|[1-9]\d*)\.(0|[1-9]\d*)(?:-([0-9A-Za-z.-]+))?(?:\+[0-9A-Za-z.-]+)?$`)
+
+	// invalidTagChars matches characters not allowed in an image tag
+	invalidTagChars = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+)
+
+// maximum length of an image tag
+const maxTagLength = 128
+
+// suffix of every tag computed from a source with uncommitted changes
+const dirtySuffix = "-dirty"
+
+// tagPolicy decides which tags are computed from git metadata.
+type tagPolicy struct {
+	// tag releases as latest
+	Latest bool
+	// allow prereleases to move the latest, vX.Y, and vX tags
+	Prerelease bool
+	// tag with the short commit SHA
+	Sha bool
+	// tag with the branch name
+	Branch bool
+}
+
+type semver struct {
+	Major, Minor, Patch int
+	Prerelease          string
+}
+
+// Compute image tags from the git metadata of the source directory.
+//
+// The tagging policy is:
+//   - a semver tag on the commit, e.g. v1.2.3, is tagged vX.Y.Z, and moves the vX.Y, vX, and latest tags
+//     if it is the highest version among all tags in the repository with the same minor, major, or any version
+//   - prereleases, e.g. v1.2.3-rc.1, only move vX.Y, vX, and latest if prerelease is set
+//   - the short commit SHA and the branch name are tagged
+//   - uncommitted changes suffix every tag with -dirty, and never move vX.Y, vX, or latest
+//
+// The source directory must include the .git directory.
+func (m *Docker) Tags(ctx context.Context,
+	// tag releases as latest
+	// +optional
+	// +default=true
+	latest bool,
+	// allow prereleases to move the latest, vX.Y, and vX tags
+	// +optional
+	prerelease bool,
+	// tag with the short commit SHA
+	// +optional
+	// +default=true
+	sha bool,
+	// tag with the branch name
+	// +optional
+	// +default=true
+	branch bool,
+) ([]string, error) {
+	meta, err := m.gitMetadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return computeTags(meta, tagPolicy{
+		Latest:     latest,
+		Prerelease: prerelease,
+		Sha:        sha,
+		Branch:     branch,
+	}), nil
+}
+
+// Publish to an address with tags computed from the git metadata of the source directory.
+//
+// See Tags for the tagging policy.
+func (m *Docker) WithGitTags(ctx context.Context,
+	// registry address to publish to
+	address string,
+	// tag releases as latest
+	// +optional
+	// +default=true
+	latest bool,
+	// allow prereleases to move the latest, vX.Y, and vX tags
+	// +optional
+	prerelease bool,
+	// tag with the short commit SHA
+	// +optional
+	// +default=true
+	sha bool,
+	// tag with the branch name
+	// +optional
+	// +default=true
+	branch bool,
+) (*Docker, error) {
+	tags, err := m.Tags(ctx, latest, prerelease, sha, branch)
+	if err != nil {
+		return nil, err
+	}
+	if len(tags) == 0 {
+		return nil, fmt.Errorf("no tags computed for %s", address)
+	}
+
+	return m.WithPublish(address, tags), nil
+}
+
+// computeTags applies a tagging policy to git metadata.
+func computeTags(meta *gitMetadata, policy tagPolicy) []string {
+	var tags []string
+
+	if v, ok := latestSemver(meta.Tags); ok {
+		tags = append(tags, fmt.Sprintf("v%d.%d.%d", v.Major, v.Minor, v.Patch))
+		if v.Prerelease != "" {
+			tags[0] += "-" + v.Prerelease
+		}
+
+		if !meta.Dirty && (v.Prerelease == "" || policy.Prerelease) {
+			// a floating tag only moves to the highest version in its scope, e.g. a hotfix
+			// of an older release does not move latest
+			highest := func(scope func(semver) bool) bool {
+				for _, other := range parseSemvers(meta.AllTags) {
+					if (other.Prerelease == "" || policy.Prerelease) && scope(other) && compareSemver(other, v) > 0 {
+						return false
+					}
+				}
+				return true
+			}
+
+			if highest(func(o semver) bool { return o.Major == v.Major && o.Minor == v.Minor }) {
+				tags = append(tags, fmt.Sprintf("v%d.%d", v.Major, v.Minor))
+			}
+			if highest(func(o semver) bool { return o.Major == v.Major }) {
+				tags = append(tags, fmt.Sprintf("v%d", v.Major))
+			}
+			if policy.Latest && highest(func(semver) bool { return true }) {
+				tags = append(tags, "latest")
+			}
+		}
+	}
+
+	if policy.Sha && len(meta.Revision) >= 7 {
+		tags = append(tags, meta.Revision[:7])
+	}
+
+	if policy.Branch && meta.Branch != "" && meta.Branch != "HEAD" {
+		if tag := sanitizeTag(meta.Branch); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+
+	if meta.Dirty {
+		for i, tag := range tags {
+			// truncated before adding the suffix, so it is never cut off
+			tag = sanitizeTag(tag)
+			tags[i] = tag[:min(len(tag), maxTagLength-len(dirtySuffix))] + dirtySuffix
+		}
+	}
+
+	return tags
+}
+
+// latestSemver returns the highest semantic version among tags.
+func latestSemver(tags []string) (semver, bool) {
+	versions := parseSemvers(tags)
+	if len(versions) == 0 {
+		return semver{}, false
+	}
+	return slices.MaxFunc(versions, compareSemver), true
+}
+
+// parseSemvers returns the tags that are semantic versions.
+func parseSemvers(tags []string) []semver {
+	var versions []semver
+	for _, tag := range tags {
+		match := semverRegexp.FindStringSubmatch(tag)
+		if match == nil {
+			continue
+		}
+		major, _ := strconv.Atoi(match[1])
+		minor, _ := strconv.Atoi(match[2])
+		patch, _ := strconv.Atoi(match[3])
+		versions = append(versions, semver{Major: major, Minor: minor, Patch: patch, Prerelease: match[4]})
+	}
+	return versions
+}
+
+// compareSemver orders semantic versions, where a release is higher than its prereleases.
+func compareSemver(a, b semver) int {
+	if c := cmp.Or(
+		cmp.Compare(a.Major, b.Major),
+		cmp.Compare(a.Minor, b.Minor),
+		cmp.Compare(a.Patch, b.Patch),
+	); c != 0 {
+		return c
+	}
+
+	switch {
+	case a.Prerelease == b.Prerelease:
+		return 0
+	case a.Prerelease == "":
+		return 1
+	case b.Prerelease == "":
+		return -1
+	}
+	return comparePrerelease(a.Prerelease, b.Prerelease)
+}
+
+// comparePrerelease orders prereleases by their dot separated identifiers, where numeric identifiers
+// are compared as numbers and are lower than alphanumeric ones, e.g. rc.9 < rc.10 < rc.beta.
+func comparePrerelease(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := range min(len(as), len(bs)) {
+		an, aErr := strconv.Atoi(as[i])
+		bn, bErr := strconv.Atoi(bs[i])
+		var c int
+		switch {
+		case aErr == nil && bErr == nil:
+			c = cmp.Compare(an, bn)
+		case aErr == nil:
+			c = -1
+		case bErr == nil:
+			c = 1
+		default:
+			c = cmp.Compare(as[i], bs[i])
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return cmp.Compare(len(as), len(bs))
+}
+
+// sanitizeTag replaces characters not allowed in an image tag, e.g. a "/" in a branch name, and
+// removes leading periods and dashes, which a tag may not start with.
+func sanitizeTag(tag string) string {
+	tag = invalidTagChars.ReplaceAllString(tag, "-")
+	tag = strings.TrimLeft(tag, ".-")
+	if len(tag) > maxTagLength {
+		tag = tag[:maxTagLength]
+	}
+	return tag
+}
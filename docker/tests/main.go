@@ -0,0 +1,323 @@
+// A module for testing the docker module.
+
+package main
+
+import (
+	"context"
+	"dagger/tests/internal/dagger"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+type Tests struct{}
+
+// Run all tests.
+func (m *Tests) All(ctx context.Context) error {
+	var errs []error
+
+	errs = append(errs, m.TestTarball(ctx))
+	errs = append(errs, m.TestSignVerify(ctx))
+	errs = append(errs, m.TestBuildSignVerify(ctx))
+	errs = append(errs, m.TestLint(ctx))
+	errs = append(errs, m.TestStructure(ctx))
+	errs = append(errs, m.TestArchive(ctx))
+	errs = append(errs, m.TestPinBaseImages(ctx))
+	errs = append(errs, m.TestTags(ctx))
+
+	return errors.Join(errs...)
+}
+
+// Test exporting a multi-platform build as a tarball without publishing.
+func (m *Tests) TestTarball(ctx context.Context) error {
+	_, err := dag.Docker(dagger.DockerOpts{Source: testDir()}).
+		Tarball(dagger.DockerTarballOpts{
+			Platforms: []dagger.Platform{"linux/amd64", "linux/arm64"},
+		}).
+		Size(ctx)
+
+	return err
+}
+
+// Test signing an image in a local registry and verifying its signature.
+func (m *Tests) TestSignVerify(ctx context.Context) error {
+	registry := registryService()
+
+	ref, err := pushTestImage(ctx, registry, "registry:5000/test:sign")
+	if err != nil {
+		return err
+	}
+
+	keys := cosignKeys()
+	privateKey, err := keys.File("cosign.key").Contents(ctx)
+	if err != nil {
+		return fmt.Errorf("generating key pair: %w", err)
+	}
+
+	docker := dag.Docker(dagger.DockerOpts{Source: testDir()}).
+		WithRegistryService("registry", registry)
+
+	if err := docker.Sign(ctx, ref, dag.SetSecret("cosign-key", privateKey)); err != nil {
+		return err
+	}
+
+	_, err = docker.Verify(ctx, ref, keys.File("cosign.pub"))
+	return err
+}
+
+// Test building and publishing to a local registry with attestations, then verifying the signature of the published image.
+func (m *Tests) TestBuildSignVerify(ctx context.Context) error {
+	registry := registryService()
+
+	keys := cosignKeys()
+	privateKey, err := keys.File("cosign.key").Contents(ctx)
+	if err != nil {
+		return fmt.Errorf("generating key pair: %w", err)
+	}
+
+	docker := dag.Docker(dagger.DockerOpts{Source: testDir()}).
+		WithRegistryService("registry", registry).
+		WithPublish("registry:5000/test", []string{"build"}).
+		WithSigningKey(dag.SetSecret("build-cosign-key", privateKey)).
+		WithSbom().
+		WithProvenance()
+
+	results, err := docker.Build(ctx)
+	if err != nil {
+		return err
+	}
+	if len(results) != 1 {
+		return fmt.Errorf("expected 1 publish result, got %d", len(results))
+	}
+	ref, err := results[0].PinnedRef(ctx)
+	if err != nil {
+		return err
+	}
+
+	if _, err := docker.Verify(ctx, ref, keys.File("cosign.pub")); err != nil {
+		return err
+	}
+
+	// a single platform is published as an image manifest, so attestations refer to the pinned reference
+	referrers, err := dag.Wolfi().
+		Container(dagger.WolfiContainerOpts{Packages: []string{"oras"}}).
+		WithServiceBinding("registry", registry).
+		WithExec([]string{"oras", "discover", "--plain-http", "--format", "json", ref}).
+		Stdout(ctx)
+	if err != nil {
+		return fmt.Errorf("discovering referrers of %s: %w", ref, err)
+	}
+	for _, mediaType := range []string{"application/spdx+json", "application/vnd.in-toto+json"} {
+		if !strings.Contains(referrers, mediaType) {
+			return fmt.Errorf("expected a %s attestation of %s, got referrers:\n%s", mediaType, ref, referrers)
+		}
+	}
+	return nil
+}
+
+// Test linting a Dockerfile, failing on errors.
+func (m *Tests) TestLint(ctx context.Context) error {
+	_, err := dag.Docker(dagger.DockerOpts{Source: testDir()}).
+		Lint(dagger.DockerLintOpts{Severity: "error"}).
+		File("hadolint.sarif").
+		Contents(ctx)
+
+	return err
+}
+
+// Test structure assertions against the ci and release targets.
+func (m *Tests) TestStructure(ctx context.Context) error {
+	spec := dag.Directory().
+		WithNewFile("spec.yaml", `schemaVersion: 2.0.0
+commandTests:
+  - name: "ok file is readable"
+    command: "cat"
+    args: ["/ok"]
+    expectedOutput: ["^ok"]
+fileExistenceTests:
+  - name: "no docker socket"
+    path: "/var/run/docker.sock"
+    shouldExist: false
+`).
+		File("spec.yaml")
+
+	docker := dag.Docker(dagger.DockerOpts{Source: testDir()})
+
+	var errs []error
+	for _, target := range []string{"ci", "release"} {
+		_, err := docker.Test(spec, dagger.DockerTestOpts{Target: target}).
+			File("linux-amd64/junit.xml").
+			Contents(ctx)
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// Test exporting a multi-platform build with attestations as an archive and publishing it to a local registry.
+func (m *Tests) TestArchive(ctx context.Context) error {
+	docker := dag.Docker(dagger.DockerOpts{Source: testDir()}).
+		WithRegistryService("registry", registryService()).
+		WithPublish("registry:5000/test", []string{"archive"}).
+		WithSbom().
+		WithProvenance()
+
+	archive := docker.ExportArchive(dagger.DockerExportArchiveOpts{
+		Platforms: []dagger.Platform{"linux/amd64", "linux/arm64"},
+	})
+
+	results, err := docker.PublishArchive(ctx, archive)
+	if err != nil {
+		return err
+	}
+	if len(results) != 1 {
+		return fmt.Errorf("expected 1 publish result, got %d", len(results))
+	}
+	return nil
+}
+
+// Test pinning base images of a multi-stage Dockerfile, leaving references to earlier stages unchanged.
+func (m *Tests) TestPinBaseImages(ctx context.Context) error {
+	pinned, err := dag.Docker(dagger.DockerOpts{Source: testDir()}).
+		PinBaseImages().
+		File("Dockerfile").
+		Contents(ctx)
+	if err != nil {
+		return err
+	}
+
+	if !strings.Contains(pinned, "FROM docker.io/library/alpine:3@sha256:") {
+		return fmt.Errorf("expected alpine to be pinned by digest, got:\n%s", pinned)
+	}
+	if !strings.Contains(pinned, "FROM ci AS release") {
+		return fmt.Errorf("expected stage reference to be unchanged, got:\n%s", pinned)
+	}
+	return nil
+}
+
+// Test that floating tags only move to the highest version in their scope.
+func (m *Tests) TestTags(ctx context.Context) error {
+	cases := []struct {
+		name string
+		// tags created on successive commits, the last is checked out
+		tags       []string
+		prerelease bool
+		want       []string
+		notWant    []string
+	}{
+		{
+			name:    "hotfix of an older major",
+			tags:    []string{"v1.2.3", "v2.0.0", "v1.2.4"},
+			want:    []string{"v1.2.4", "v1.2", "v1"},
+			notWant: []string{"latest"},
+		},
+		{
+			name:    "hotfix of an older minor",
+			tags:    []string{"v1.2.3", "v1.3.0", "v1.2.4"},
+			want:    []string{"v1.2.4", "v1.2"},
+			notWant: []string{"v1", "latest"},
+		},
+		{
+			name: "highest release",
+			tags: []string{"v1.2.3", "v1.10.0"},
+			want: []string{"v1.10.0", "v1.10", "v1", "latest"},
+		},
+		{
+			name:       "numeric prerelease identifiers",
+			tags:       []string{"v3.0.0-rc.9", "v3.0.0-rc.10"},
+			prerelease: true,
+			want:       []string{"v3.0.0-rc.10", "v3.0", "v3", "latest"},
+		},
+		{
+			name:    "prerelease without prerelease policy",
+			tags:    []string{"v1.0.0", "v2.0.0-rc.1"},
+			want:    []string{"v2.0.0-rc.1"},
+			notWant: []string{"v2.0", "v2", "latest"},
+		},
+	}
+
+	var errs []error
+	for _, tc := range cases {
+		tags, err := dag.Docker(dagger.DockerOpts{Source: gitRepo(tc.tags)}).
+			Tags(ctx, dagger.DockerTagsOpts{Prerelease: tc.prerelease})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", tc.name, err))
+			continue
+		}
+		for _, tag := range tc.want {
+			if !slices.Contains(tags, tag) {
+				errs = append(errs, fmt.Errorf("%s: expected tag %s, got %v", tc.name, tag, tags))
+			}
+		}
+		for _, tag := range tc.notWant {
+			if slices.Contains(tags, tag) {
+				errs = append(errs, fmt.Errorf("%s: unexpected tag %s, got %v", tc.name, tag, tags))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// gitRepo provides a git repository with a commit for each tag, checked out at the last.
+func gitRepo(tags []string) *dagger.Directory {
+	ctr := dag.Wolfi().
+		Container(dagger.WolfiContainerOpts{Packages: []string{"git"}}).
+		WithWorkdir("/work/src").
+		WithEnvVariable("GIT_AUTHOR_NAME", "test").
+		WithEnvVariable("GIT_AUTHOR_EMAIL", "test@example.com").
+		WithEnvVariable("GIT_COMMITTER_NAME", "test").
+		WithEnvVariable("GIT_COMMITTER_EMAIL", "test@example.com").
+		WithExec([]string{"git", "init", "--initial-branch", "main"})
+
+	for _, tag := range tags {
+		ctr = ctr.
+			WithExec([]string{"git", "commit", "--allow-empty", "--message", tag}).
+			WithExec([]string{"git", "tag", tag})
+	}
+	return ctr.Directory("/work/src")
+}
+
+// registryService provides a local registry:2 service, reachable at registry:5000.
+func registryService() *dagger.Service {
+	return dag.Container().
+		From("docker.io/library/registry:2").
+		WithExposedPort(5000).
+		AsService()
+}
+
+// cosignKeys generates an unencrypted cosign key pair, as cosign.key and cosign.pub in the working directory.
+func cosignKeys() *dagger.Container {
+	// COSIGN_PASSWORD is empty, so the key is unencrypted
+	return dag.Wolfi().
+		Container(dagger.WolfiContainerOpts{Packages: []string{"cosign"}}).
+		WithWorkdir("/work").
+		WithEnvVariable("COSIGN_PASSWORD", "").
+		WithExec([]string{"cosign", "generate-key-pair"})
+}
+
+// pushTestImage pushes an image built from testDir to a registry service, returning its reference pinned by digest.
+func pushTestImage(ctx context.Context, registry *dagger.Service, ref string) (string, error) {
+	tarball := dag.Docker(dagger.DockerOpts{Source: testDir()}).Tarball()
+
+	out, err := dag.Wolfi().
+		Container(dagger.WolfiContainerOpts{Packages: []string{"crane"}}).
+		WithServiceBinding("registry", registry).
+		WithMountedFile("/work/image.tar", tarball).
+		WithExec([]string{"crane", "push", "--insecure", "/work/image.tar", ref}).
+		Stdout(ctx)
+	if err != nil {
+		return "", fmt.Errorf("pushing test image: %w", err)
+	}
+
+	return strings.TrimSpace(out), nil
+}
+
+// testDir provides a source directory with a multi-stage Dockerfile used for testing.
+func testDir() *dagger.Directory {
+	return dag.Directory().
+		WithNewFile("Dockerfile", `FROM docker.io/library/alpine:3 AS ci
+RUN echo ok > /ok
+
+FROM ci AS release
+`)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"dagger/docker/internal/dagger"
+	"strings"
+	"time"
+)
+
+// registryPasswordPath is where a registry password is briefly mounted while logging in.
+const registryPasswordPath = "/run/secrets/registry-password"
+
+// tools returns a container with crane and the given wolfi packages installed,
+// logged in to every registry added with WithRegistryCreds or WithDockerConfig.
+//
+// Logging in with crane writes ~/.docker/config.json, which is shared by every
+// registry client in the container (cosign, oras, syft, trivy, etc.).
+func (docker *Docker) tools(packages ...string) *dagger.Container {
+	ctr := dag.Wolfi().Container(dagger.WolfiContainerOpts{
+		Packages: append([]string{"crane"}, packages...),
+	})
+
+	for _, svc := range docker.RegistryServices {
+		ctr = ctr.WithServiceBinding(svc.Hostname, svc.Service)
+	}
+
+	for _, creds := range docker.RegistryCreds {
+		ctr = ctr.
+			WithMountedSecret(registryPasswordPath, creds.Password).
+			WithExec([]string{"sh", "-c",
+				`crane auth login "$1" --username "$2" --password-stdin < ` + registryPasswordPath,
+				"login", creds.Registry, creds.Username,
+			}).
+			WithoutMount(registryPasswordPath)
+	}
+
+	// registries are mutable, so results of registry clients must not be cached between calls
+	return ctr.WithEnvVariable("CACHE_BUSTER", time.Now().Format(time.RFC3339Nano))
+}
+
+// insecureFlag returns flag if the registry of ref was bound with WithRegistryService,
+// which is only reachable over plain HTTP.
+func (docker *Docker) insecureFlag(ref string, flag string) []string {
+	host, _, _ := strings.Cut(ref, "/")
+	host, _, _ = strings.Cut(host, ":")
+	for _, svc := range docker.RegistryServices {
+		if svc.Hostname == host {
+			return []string{flag}
+		}
+	}
+	return nil
+}
+
+// platformDir returns a directory name for a platform's files, e.g. linux-arm-v7.
+func platformDir(platform dagger.Platform) string {
+	return strings.ReplaceAll(string(platform), "/", "-")
+}
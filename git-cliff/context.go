@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Release is a version of the changelog, or unreleased changes if Version is empty.
+type Release struct {
+	// Version of the release, empty for unreleased changes.
+	Version string
+	// Version of the previous release, empty for the first release.
+	PreviousVersion string
+	// Commit the release is tagged on.
+	CommitID string
+	// Time of the release commit, in seconds since the Unix epoch.
+	Timestamp int
+	// Message of an annotated release tag.
+	Message string
+	// Commits of the release.
+	Commits []*Commit
+	// Commits of the release, grouped by the commit parsers of the configuration.
+	Groups []*CommitGroup
+}
+
+// CommitGroup is the commits of a release in the same group, e.g. "Features".
+type CommitGroup struct {
+	Name    string
+	Commits []*Commit
+}
+
+// Commit is a commit processed by git-cliff.
+type Commit struct {
+	// Commit SHA.
+	ID string
+	// Commit message, or the description of a conventional commit.
+	Message string
+	// Body of a conventional commit.
+	Body string
+	// Group assigned by the commit parsers.
+	Group string
+	// Scope of a conventional commit.
+	Scope string
+	// Whether the commit follows the conventional commits specification.
+	Conventional bool
+	// Whether the commit is a breaking change.
+	Breaking bool
+	// Description of a breaking change.
+	BreakingDescription string
+	// Whether the commit is a merge commit.
+	MergeCommit bool
+	// Unprocessed commit message.
+	RawMessage string
+	Author     *Signature
+	Committer  *Signature
+}
+
+// Signature is the author or committer of a commit.
+type Signature struct {
+	Name  string
+	Email string
+	// Time of the signature, in seconds since the Unix epoch.
+	Timestamp int
+}
+
+// contextRelease is a release in the output of `git-cliff --context`.
+type contextRelease struct {
+	Version   *string          `json:"version"`
+	Message   *string          `json:"message"`
+	Commits   []*contextCommit `json:"commits"`
+	CommitID  *string          `json:"commit_id"`
+	Timestamp int              `json:"timestamp"`
+	Previous  *struct {
+		Version *string `json:"version"`
+	} `json:"previous"`
+}
+
+// contextCommit is a commit in the output of `git-cliff --context`.
+type contextCommit struct {
+	ID                  string            `json:"id"`
+	Message             string            `json:"message"`
+	Body                *string           `json:"body"`
+	Group               *string           `json:"group"`
+	Scope               *string           `json:"scope"`
+	Conventional        bool              `json:"conventional"`
+	Breaking            bool              `json:"breaking"`
+	BreakingDescription *string           `json:"breaking_description"`
+	MergeCommit         bool              `json:"merge_commit"`
+	RawMessage          *string           `json:"raw_message"`
+	Author              *contextSignature `json:"author"`
+	Committer           *contextSignature `json:"committer"`
+}
+
+// contextSignature is a signature in the output of `git-cliff --context`.
+type contextSignature struct {
+	Name      *string `json:"name"`
+	Email     *string `json:"email"`
+	Timestamp int     `json:"timestamp"`
+}
+
+// parseContext parses the output of `git-cliff --context`.
+func parseContext(out string) ([]*Release, error) {
+	var raw []*contextRelease
+	if err := json.Unmarshal([]byte(out), &raw); err != nil {
+		return nil, fmt.Errorf("parsing git-cliff context: %w", err)
+	}
+
+	releases := make([]*Release, 0, len(raw))
+	for _, r := range raw {
+		release := &Release{
+			Version:   deref(r.Version),
+			CommitID:  deref(r.CommitID),
+			Timestamp: r.Timestamp,
+			Message:   deref(r.Message),
+			Commits:   make([]*Commit, 0, len(r.Commits)),
+		}
+		if r.Previous != nil {
+			release.PreviousVersion = deref(r.Previous.Version)
+		}
+
+		groups := make(map[string]*CommitGroup)
+		for _, c := range r.Commits {
+			commit := &Commit{
+				ID:                  c.ID,
+				Message:             c.Message,
+				Body:                deref(c.Body),
+				Group:               deref(c.Group),
+				Scope:               deref(c.Scope),
+				Conventional:        c.Conventional,
+				Breaking:            c.Breaking,
+				BreakingDescription: deref(c.BreakingDescription),
+				MergeCommit:         c.MergeCommit,
+				RawMessage:          deref(c.RawMessage),
+				Author:              c.Author.signature(),
+				Committer:           c.Committer.signature(),
+			}
+			release.Commits = append(release.Commits, commit)
+
+			// groups are ordered by their first commit
+			group, ok := groups[commit.Group]
+			if !ok {
+				group = &CommitGroup{Name: commit.Group}
+				groups[commit.Group] = group
+				release.Groups = append(release.Groups, group)
+			}
+			group.Commits = append(group.Commits, commit)
+		}
+
+		releases = append(releases, release)
+	}
+	return releases, nil
+}
+
+func (s *contextSignature) signature() *Signature {
+	if s == nil {
+		return &Signature{}
+	}
+	return &Signature{
+		Name:      deref(s.Name),
+		Email:     deref(s.Email),
+		Timestamp: s.Timestamp,
+	}
+}
+
+// deref returns the value of a nullable string, or empty if null.
+func deref(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
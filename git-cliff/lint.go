@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"dagger/git-cliff/internal/dagger"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"strings"
+)
+
+// names of the reports returned by LintCommits
+const (
+	lintJUnitReport       = "junit.xml"
+	lintCodeQualityReport = "gl-code-quality-report.json"
+)
+
+// commitViolation is a commit that would be missing from the changelog, or unclassified in it.
+type commitViolation struct {
+	Commit *Commit
+	Check  string
+	Reason string
+}
+
+// Check every commit in a revision range against the commit parsers of the active configuration, e.g. in merge requests.
+//
+// Commits are violations if they would be dropped from the changelog, by filter_unconventional or
+// filter_commits, or would end up without a group. Commits skipped by a parser are not violations.
+// Returns JUnit (junit.xml) and GitLab code quality (gl-code-quality-report.json) reports, failing
+// if there are violations.
+//
+// e.g. `git-cliff --context <revisions>`.
+func (gc *GitCliff) LintCommits(ctx context.Context,
+	// Revision range to check, e.g. main..HEAD.
+	revisions string,
+	// Return reports without failing on violations.
+	// +optional
+	noFail bool,
+) (*dagger.Directory, error) {
+	if gc.Range != "" {
+		return nil, fmt.Errorf("linting commits cannot be used with %s", gc.Range)
+	}
+
+	kept, err := gc.contextCommits(ctx, revisions)
+	if err != nil {
+		return nil, err
+	}
+
+	// without filtering, only commits skipped by a parser are left out
+	unfiltered, err := gc.withContainer(gc.Container.
+		WithEnvVariable("GIT_CLIFF__GIT__FILTER_UNCONVENTIONAL", "false").
+		WithEnvVariable("GIT_CLIFF__GIT__FILTER_COMMITS", "false"),
+	).contextCommits(ctx, revisions)
+	if err != nil {
+		return nil, err
+	}
+
+	keptIDs := make(map[string]bool, len(kept))
+	for _, commit := range kept {
+		keptIDs[commit.ID] = true
+	}
+
+	var violations []commitViolation
+	for _, commit := range unfiltered {
+		switch {
+		case !keptIDs[commit.ID] && !commit.Conventional:
+			violations = append(violations, commitViolation{commit, "unconventional", "not a conventional commit, dropped from the changelog"})
+		case !keptIDs[commit.ID]:
+			violations = append(violations, commitViolation{commit, "dropped", "matches no commit parser, dropped from the changelog"})
+		case commit.Group == "":
+			violations = append(violations, commitViolation{commit, "unclassified", "matches no commit parser, not assigned a group"})
+		}
+	}
+
+	junit, err := commitJUnitReport(revisions, unfiltered, violations)
+	if err != nil {
+		return nil, err
+	}
+	codeQuality, err := commitCodeQualityReport(violations)
+	if err != nil {
+		return nil, err
+	}
+	reports := dag.Directory().
+		WithNewFile(lintJUnitReport, junit).
+		WithNewFile(lintCodeQualityReport, codeQuality)
+
+	if len(violations) == 0 || noFail {
+		return reports, nil
+	}
+
+	lines := make([]string, 0, len(violations))
+	for _, v := range violations {
+		lines = append(lines, fmt.Sprintf("%s: %s", commitTitle(v.Commit), v.Reason))
+	}
+	return reports, fmt.Errorf("%d of %d commits in %s violate the commit parsers:\n%s",
+		len(violations), len(unfiltered), revisions, strings.Join(lines, "\n"))
+}
+
+// contextCommits returns the commits of every release in a revision range, once each.
+func (gc *GitCliff) contextCommits(ctx context.Context, revisions string) ([]*Commit, error) {
+	out, err := gc.Container.
+		WithExec(gc.withoutOutput().args("--context", revisions)).
+		Stdout(ctx)
+	if err != nil {
+		return nil, err
+	}
+	releases, err := parseContext(out)
+	if err != nil {
+		return nil, err
+	}
+
+	// split_commits may produce several commits with the same ID
+	seen := make(map[string]bool)
+	var commits []*Commit
+	for _, release := range releases {
+		for _, commit := range release.Commits {
+			if !seen[commit.ID] {
+				seen[commit.ID] = true
+				commits = append(commits, commit)
+			}
+		}
+	}
+	return commits, nil
+}
+
+// commitTitle returns the abbreviated ID and first line of a commit message.
+func commitTitle(commit *Commit) string {
+	message := commit.RawMessage
+	if message == "" {
+		message = commit.Message
+	}
+	title, _, _ := strings.Cut(message, "\n")
+	id := commit.ID
+	if len(id) > 7 {
+		id = id[:7]
+	}
+	return id + " " + title
+}
+
+type junitTestSuite struct {
+	XMLName   xml.Name        `xml:"testsuite"`
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	TestCases []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name    string        `xml:"name,attr"`
+	Failure *junitFailure `xml:"failure,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// commitJUnitReport encodes a test case for each commit as a JUnit XML test suite.
+func commitJUnitReport(revisions string, commits []*Commit, violations []commitViolation) (string, error) {
+	failures := make(map[string]commitViolation, len(violations))
+	for _, v := range violations {
+		failures[v.Commit.ID] = v
+	}
+
+	suite := junitTestSuite{Name: "commits " + revisions, Tests: len(commits)}
+	for _, commit := range commits {
+		tc := junitTestCase{Name: commitTitle(commit)}
+		if v, ok := failures[commit.ID]; ok {
+			suite.Failures++
+			tc.Failure = &junitFailure{
+				Message: v.Reason,
+				Text:    commit.RawMessage,
+			}
+		}
+		suite.TestCases = append(suite.TestCases, tc)
+	}
+
+	b, err := xml.MarshalIndent(suite, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("encoding junit report: %w", err)
+	}
+	return xml.Header + string(b) + "\n", nil
+}
+
+// codeQualityIssue is an issue in a GitLab code quality report.
+type codeQualityIssue struct {
+	Description string              `json:"description"`
+	CheckName   string              `json:"check_name"`
+	Fingerprint string              `json:"fingerprint"`
+	Severity    string              `json:"severity"`
+	Location    codeQualityLocation `json:"location"`
+}
+
+type codeQualityLocation struct {
+	Path  string `json:"path"`
+	Lines struct {
+		Begin int `json:"begin"`
+	} `json:"lines"`
+}
+
+// commitCodeQualityReport encodes violations as a GitLab code quality report.
+//
+// Commits have no file, so issues are located at the git directory.
+func commitCodeQualityReport(violations []commitViolation) (string, error) {
+	issues := make([]codeQualityIssue, 0, len(violations))
+	for _, v := range violations {
+		fingerprint := sha256.Sum256([]byte(v.Check + ":" + v.Commit.ID))
+		issue := codeQualityIssue{
+			Description: fmt.Sprintf("%s: %s", commitTitle(v.Commit), v.Reason),
+			CheckName:   "git-cliff/" + v.Check,
+			Fingerprint: hex.EncodeToString(fingerprint[:]),
+			Severity:    "major",
+		}
+		issue.Location.Path = ".git"
+		issue.Location.Lines.Begin = 1
+		issues = append(issues, issue)
+	}
+
+	b, err := json.MarshalIndent(issues, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("encoding code quality report: %w", err)
+	}
+	return string(b) + "\n", nil
+}
@@ -5,17 +5,28 @@ import (
 	"context"
 	"dagger/git-cliff/internal/dagger"
 	"fmt"
+	"slices"
+	"strings"
 )
 
 const (
 	imageGitCliff = "docker.io/orhunp/git-cliff" // default: "latest"
 )
 
+// parts of the changelog that may be stripped with WithStrip
+var stripParts = []string{"header", "footer", "all"}
+
+// GitCliff is an immutable builder, each With* function returns a modified copy.
 type GitCliff struct {
 	Container *dagger.Container
 
 	// +private
 	Flags []string
+	// commit range flag, one of --latest, --current, or --unreleased
+	// +private
+	Range string
+	// +private
+	Strip string
 }
 
 func New(
@@ -47,14 +58,13 @@ func (gc *GitCliff) WithEnvVariable(
 	// +optional
 	expand bool,
 ) *GitCliff {
-	gc.Container = gc.Container.WithEnvVariable(
+	return gc.withContainer(gc.Container.WithEnvVariable(
 		name,
 		value,
 		dagger.ContainerWithEnvVariableOpts{
 			Expand: expand,
 		},
-	)
-	return gc
+	))
 }
 
 // WithSecretVariable adds an env variable containing a secret to the git-cliff container.
@@ -66,8 +76,7 @@ func (gc *GitCliff) WithSecretVariable(
 	// The value of the environment variable containing a secret.
 	secret *dagger.Secret,
 ) *GitCliff {
-	gc.Container = gc.Container.WithSecretVariable(name, secret)
-	return gc
+	return gc.withContainer(gc.Container.WithSecretVariable(name, secret))
 }
 
 // Add netrc credentials.
@@ -75,8 +84,7 @@ func (gc *GitCliff) WithNetrc(
 	// NETRC credentials
 	netrc *dagger.Secret,
 ) *GitCliff {
-	gc.Container = gc.Container.WithMountedSecret("/root/.netrc", netrc)
-	return gc
+	return gc.withContainer(gc.Container.WithMountedSecret("/root/.netrc", netrc))
 }
 
 // Sets the configuration file.
@@ -87,9 +95,8 @@ func (gc *GitCliff) WithConfig(
 	config *dagger.File,
 ) *GitCliff {
 	configPath := "/work/cliff.toml"
-	gc.Container = gc.Container.WithMountedFile(configPath, config)
-	gc.Flags = append(gc.Flags, "--config", configPath)
-	return gc
+	return gc.withContainer(gc.Container.WithMountedFile(configPath, config)).
+		with("--config", configPath)
 }
 
 // Run git-cliff with all options previously provided.
@@ -100,17 +107,48 @@ func (gc *GitCliff) Run(
 	// +optional
 	args []string,
 ) *dagger.Container {
-	gc.Flags = append(gc.Flags, args...)
-	return gc.Container.WithExec(gc.Flags)
+	return gc.Container.WithExec(gc.args(args...))
 }
 
 // Prints bumped version for unreleased changes.
 func (gc *GitCliff) BumpedVersion(ctx context.Context) (string, error) {
-	gc.Flags = append(gc.Flags, "--bumped-version")
-	return gc.Container.WithExec(gc.Flags).
+	return gc.Container.WithExec(gc.args("--bumped-version")).
 		Stdout(ctx)
 }
 
+// Generates the changelog with all options previously provided, returning it as a file.
+//
+// If WithOutput or WithPrepend was used, the written file is returned, relative to the source git directory.
+//
+// e.g. `git-cliff > CHANGELOG.md`.
+func (gc *GitCliff) Changelog() *dagger.File {
+	if path := gc.outputPath(); path != "" {
+		return gc.Container.
+			WithExec(gc.args()).
+			File(path)
+	}
+
+	changelogPath := "/work/CHANGELOG.md"
+	return gc.Container.
+		WithExec(gc.args(), dagger.ContainerWithExecOpts{RedirectStdout: changelogPath}).
+		File(changelogPath)
+}
+
+// Returns the releases of the changelog with all options previously provided, as processed for the changelog template.
+//
+// WithOutput and WithPrepend are ignored, the context is never written to a file.
+//
+// e.g. `git-cliff --context`.
+func (gc *GitCliff) Context(ctx context.Context) ([]*Release, error) {
+	out, err := gc.Container.
+		WithExec(gc.withoutOutput().args("--context")).
+		Stdout(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return parseContext(out)
+}
+
 // Sets the GitHub API token.
 //
 // e.g. `GITHUB_TOKEN=<token> git-cliff`.
@@ -149,43 +187,38 @@ func (gc *GitCliff) WithBump(
 	// +optional
 	version string,
 ) *GitCliff {
-	gc.Flags = append(gc.Flags, "--bump")
 	if version != "" {
-		gc.Flags = append(gc.Flags, version)
+		return gc.with("--bump", version)
 	}
-	return gc
+	return gc.with("--bump")
 }
 
-// Processes the commits starting from the latest tag.
+// Processes the commits starting from the latest tag. Cannot be used with WithCurrent or WithUnreleased.
 //
 // e.g. `git-cliff --latest`.
-func (gc *GitCliff) WithLatest() *GitCliff {
-	gc.Flags = append(gc.Flags, "--latest")
-	return gc
+func (gc *GitCliff) WithLatest() (*GitCliff, error) {
+	return gc.withRange("--latest")
 }
 
-// Processes the commits that belog to the current tag.
+// Processes the commits that belog to the current tag. Cannot be used with WithLatest or WithUnreleased.
 //
 // e.g. `git-cliff --current`
-func (gc *GitCliff) WithCurrent() *GitCliff {
-	gc.Flags = append(gc.Flags, "--current")
-	return gc
+func (gc *GitCliff) WithCurrent() (*GitCliff, error) {
+	return gc.withRange("--current")
 }
 
-// Processes the commits that do not belog to a tag.
+// Processes the commits that do not belog to a tag. Cannot be used with WithLatest or WithCurrent.
 //
 // e.g. `git-cliff --unreleased`.
-func (gc *GitCliff) WithUnreleased() *GitCliff {
-	gc.Flags = append(gc.Flags, "--unreleased")
-	return gc
+func (gc *GitCliff) WithUnreleased() (*GitCliff, error) {
+	return gc.withRange("--unreleased")
 }
 
 // Sorts the tags topologically.
 //
 // e.g. `git-cliff --topo-order`.
 func (gc *GitCliff) WithTopoOrder() *GitCliff {
-	gc.Flags = append(gc.Flags, "--topo-order")
-	return gc
+	return gc.with("--topo-order")
 }
 
 // Sets the git repository.
@@ -195,9 +228,7 @@ func (gc *GitCliff) WithRepository(
 	// git repository (one or more)
 	repo []string,
 ) *GitCliff {
-	gc.Flags = append(gc.Flags, "--repository")
-	gc.Flags = append(gc.Flags, repo...)
-	return gc
+	return gc.with(append([]string{"--repository"}, repo...)...)
 }
 
 // Sets comits that will be skipped in the changelog.
@@ -207,9 +238,7 @@ func (gc *GitCliff) WithSkipCommit(
 	// Commits
 	sha1 []string,
 ) *GitCliff {
-	gc.Flags = append(gc.Flags, "--skip-commit")
-	gc.Flags = append(gc.Flags, sha1...)
-	return gc
+	return gc.with(append([]string{"--skip-commit"}, sha1...)...)
 }
 
 // Prepends entries to the given changelog file.
@@ -219,8 +248,7 @@ func (gc *GitCliff) WithPrepend(
 	// Path to changelog, relative to source git directory
 	changelog string,
 ) *GitCliff {
-	gc.Flags = append(gc.Flags, "--prepend", changelog)
-	return gc
+	return gc.with("--prepend", changelog)
 }
 
 // Writes output to the fiven file.
@@ -230,8 +258,7 @@ func (gc *GitCliff) WithOutput(
 	// Write output to file, relative to source git directory.
 	path string,
 ) *GitCliff {
-	gc.Flags = append(gc.Flags, "--output", path)
-	return gc
+	return gc.with("--output", path)
 }
 
 // Strips the given parts from the changelog.
@@ -240,9 +267,74 @@ func (gc *GitCliff) WithOutput(
 func (gc *GitCliff) WithStrip(
 	// Part of changelog to strip. Possible values: header, footer, all.
 	part string,
-) *GitCliff {
-	gc.Flags = append(gc.Flags, "--strip", part)
-	return gc
+) (*GitCliff, error) {
+	if !slices.Contains(stripParts, part) {
+		return nil, fmt.Errorf("unsupported strip part %q, expected one of %s", part, strings.Join(stripParts, ", "))
+	}
+	c := gc.with()
+	c.Strip = part
+	return c, nil
+}
+
+// with returns a copy of gc with flags appended, leaving gc unchanged.
+func (gc *GitCliff) with(flags ...string) *GitCliff {
+	c := *gc
+	c.Flags = slices.Concat(gc.Flags, flags)
+	return &c
+}
+
+// withContainer returns a copy of gc with a modified container, leaving gc unchanged.
+func (gc *GitCliff) withContainer(ctr *dagger.Container) *GitCliff {
+	c := gc.with()
+	c.Container = ctr
+	return c
+}
+
+// withRange returns a copy of gc processing a commit range, failing if a different range was already set.
+func (gc *GitCliff) withRange(flag string) (*GitCliff, error) {
+	if gc.Range != "" && gc.Range != flag {
+		return nil, fmt.Errorf("%s cannot be used with %s", flag, gc.Range)
+	}
+	c := gc.with()
+	c.Range = flag
+	return c, nil
+}
+
+// outputPath returns the file written by WithOutput or WithPrepend, or empty if the changelog is written to stdout.
+func (gc *GitCliff) outputPath() string {
+	var path string
+	for i, flag := range gc.Flags[:max(len(gc.Flags)-1, 0)] {
+		if flag == "--output" || flag == "--prepend" {
+			path = gc.Flags[i+1]
+		}
+	}
+	return path
+}
+
+// withoutOutput returns a copy of gc writing to stdout, without the flags of WithOutput or WithPrepend.
+func (gc *GitCliff) withoutOutput() *GitCliff {
+	c := gc.with()
+	c.Flags = nil
+	for i := 0; i < len(gc.Flags); i++ {
+		if (gc.Flags[i] == "--output" || gc.Flags[i] == "--prepend") && i+1 < len(gc.Flags) {
+			i++
+			continue
+		}
+		c.Flags = append(c.Flags, gc.Flags[i])
+	}
+	return c
+}
+
+// args returns the git-cliff command with all options previously provided, followed by extra arguments.
+func (gc *GitCliff) args(extra ...string) []string {
+	args := slices.Clone(gc.Flags)
+	if gc.Range != "" {
+		args = append(args, gc.Range)
+	}
+	if gc.Strip != "" {
+		args = append(args, "--strip", gc.Strip)
+	}
+	return append(args, extra...)
 }
 
 // defaultContainer constructs a minimal container containing a source git repository.
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"dagger/git-cliff/internal/dagger"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// presets are git-cliff configurations embedded in the module, named by file without the extension
+//
+//go:embed presets/*.toml
+var presets embed.FS
+
+// Sets the configuration to a built-in preset.
+//
+// Supported presets: 'conventional' (conventional commits grouped by type), 'keepachangelog'
+// (Keep a Changelog format), 'github' (GitHub release notes style), and 'act3' (ACT3 style).
+//
+// e.g. `git-cliff --config <preset>.toml`.
+func (gc *GitCliff) WithPreset(
+	// name of the preset
+	preset string,
+) (*GitCliff, error) {
+	config, err := presetFile(preset)
+	if err != nil {
+		return nil, err
+	}
+	return gc.WithConfig(config), nil
+}
+
+// Generates a cliff.toml configuration file from a built-in preset, e.g. to check in and customize.
+//
+// Supported presets: 'conventional' (conventional commits grouped by type), 'keepachangelog'
+// (Keep a Changelog format), 'github' (GitHub release notes style), and 'act3' (ACT3 style).
+func (gc *GitCliff) Init(
+	// name of the preset
+	// +optional
+	// +default="conventional"
+	preset string,
+) (*dagger.File, error) {
+	return presetFile(preset)
+}
+
+// presetFile returns a built-in preset as a cliff.toml file.
+func presetFile(preset string) (*dagger.File, error) {
+	contents, err := presets.ReadFile(path.Join("presets", preset+".toml"))
+	if err != nil {
+		return nil, fmt.Errorf("unknown preset %q, expected one of %s", preset, strings.Join(presetNames(), ", "))
+	}
+	return dag.Directory().
+		WithNewFile("cliff.toml", string(contents)).
+		File("cliff.toml"), nil
+}
+
+// presetNames returns the names of the built-in presets.
+func presetNames() []string {
+	files, _ := fs.Glob(presets, "presets/*.toml")
+	names := make([]string, 0, len(files))
+	for _, file := range files {
+		names = append(names, strings.TrimSuffix(path.Base(file), ".toml"))
+	}
+	return names
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"dagger/git-cliff/internal/dagger"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+const (
+	imageGit = "docker.io/alpine/git" // default: "latest"
+)
+
+// ReleaseResult is a release prepared by Release.
+type ReleaseResult struct {
+	// Version of the release, e.g. v1.2.3.
+	Version string
+	// Source git repository, with the updated changelog committed and the release tagged.
+	Source *dagger.Directory
+	// Release notes of this version alone, without the changelog header or footer.
+	Notes *dagger.File
+}
+
+// Prepare a release: bump the version, prepend the unreleased changes to the changelog, commit it, and tag the commit.
+//
+// The tag is annotated with the release notes, and signed if an SSH signing key is provided.
+// Options previously provided are used, except commit range options, i.e. WithLatest, WithCurrent,
+// or WithUnreleased, which may not be set. WithOutput and WithPrepend may not be set either, as the
+// changelog path is provided instead. Fails if there are no unreleased changes.
+//
+// e.g. `git-cliff --bumped-version`, `git-cliff --unreleased --tag <version> --prepend <changelog>`,
+// and `git tag --annotate <version>`.
+func (gc *GitCliff) Release(ctx context.Context,
+	// Path to changelog, relative to source git directory. Written with the full history if it does not exist.
+	// +optional
+	// +default="CHANGELOG.md"
+	changelog string,
+	// Version to release, defaults to the bumped version for unreleased changes.
+	// +optional
+	version string,
+	// SSH private key used to sign the tag, the tag is annotated but not signed if unset.
+	// +optional
+	signingKey *dagger.Secret,
+	// Name of the committer and tagger.
+	// +optional
+	// +default="git-cliff"
+	name string,
+	// Email of the committer and tagger.
+	// +optional
+	// +default="git-cliff@localhost"
+	email string,
+) (*ReleaseResult, error) {
+	if gc.Range != "" {
+		return nil, fmt.Errorf("release cannot be used with %s", gc.Range)
+	}
+	if path := gc.outputPath(); path != "" {
+		return nil, fmt.Errorf("release cannot be used with WithOutput or WithPrepend of %s, the changelog is written to %s", path, changelog)
+	}
+
+	// without unreleased changes the bumped version is the latest release, which is already tagged
+	pending := gc.with()
+	pending.Range = "--unreleased"
+	releases, err := pending.Context(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("listing unreleased changes: %w", err)
+	}
+	if !slices.ContainsFunc(releases, func(r *Release) bool { return len(r.Commits) > 0 }) {
+		return nil, errors.New("no unreleased changes to release")
+	}
+
+	if version == "" {
+		bumped, err := gc.BumpedVersion(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("bumping version: %w", err)
+		}
+		version = strings.TrimSpace(bumped)
+	}
+
+	unreleased := pending.with("--tag", version)
+
+	notes := unreleased.with()
+	notes.Strip = "all"
+	notesFile := notes.Changelog()
+
+	// prepending requires an existing changelog
+	source := gc.Container.Directory("/work/src")
+	existing, err := source.Glob(ctx, changelog)
+	if err != nil {
+		return nil, fmt.Errorf("checking for %s: %w", changelog, err)
+	}
+	update := gc.with("--tag", version, "--output", changelog)
+	if len(existing) > 0 {
+		update = unreleased.with("--prepend", changelog)
+	}
+	source = update.Run(nil).Directory("/work/src")
+
+	notesPath := "/work/notes.md"
+	git := func(args ...string) []string {
+		return slices.Concat([]string{"git",
+			"-c", "safe.directory=*",
+			"-c", "user.name=" + name,
+			"-c", "user.email=" + email,
+		}, args)
+	}
+	tag := git("tag", "--annotate", "--file", notesPath)
+
+	ctr := dag.Container().
+		From(imageGit).
+		WithMountedFile(notesPath, notesFile).
+		WithMountedDirectory("/work/src", source).
+		WithWorkdir("/work/src")
+
+	if signingKey != nil {
+		keyPath := "/root/.ssh/release_signing_key"
+		ctr = ctr.WithMountedSecret(keyPath, signingKey, dagger.ContainerWithMountedSecretOpts{Mode: 0o600})
+		tag = git("-c", "gpg.format=ssh", "-c", "user.signingkey="+keyPath, "tag", "--sign", "--file", notesPath)
+	}
+
+	source = ctr.
+		WithExec(git("add", changelog)).
+		WithExec(git("commit", "--message", "chore(release): "+version)).
+		WithExec(append(tag, version)).
+		Directory("/work/src")
+
+	return &ReleaseResult{
+		Version: version,
+		Source:  source,
+		Notes:   notesFile,
+	}, nil
+}
@@ -0,0 +1,303 @@
+// A module for testing the git-cliff module.
+
+package main
+
+import (
+	"context"
+	"dagger/tests/internal/dagger"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+type Tests struct{}
+
+// Run all tests.
+func (m *Tests) All(ctx context.Context) error {
+	var errs []error
+
+	errs = append(errs, m.TestBuilderReuse(ctx))
+	errs = append(errs, m.TestContext(ctx))
+	errs = append(errs, m.TestRelease(ctx))
+	errs = append(errs, m.TestPresets(ctx))
+	errs = append(errs, m.TestLintCommits(ctx))
+
+	return errors.Join(errs...)
+}
+
+// Test that options added to a derived builder do not leak into the builder it was derived from.
+func (m *Tests) TestBuilderReuse(ctx context.Context) error {
+	base := dag.GitCliff(gitRepo()).WithPreset("conventional")
+
+	bumped, err := base.BumpedVersion(ctx)
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(bumped) != "v1.1.0" {
+		return fmt.Errorf("expected bumped version v1.1.0, got %q", bumped)
+	}
+	if _, err := base.Run(dagger.GitCliffRunOpts{Args: []string{"--tag", "v9.9.9"}}).Sync(ctx); err != nil {
+		return err
+	}
+
+	withBump, err := base.WithBump().Changelog().Contents(ctx)
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(withBump, "## [1.1.0]") {
+		return fmt.Errorf("expected bumped changelog to contain 1.1.0, got:\n%s", withBump)
+	}
+
+	changelog, err := base.Changelog().Contents(ctx)
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(changelog, "## [unreleased]") {
+		return fmt.Errorf("expected changelog of the original builder to contain unreleased changes, got:\n%s", changelog)
+	}
+	if strings.Contains(changelog, "1.1.0") || strings.Contains(changelog, "9.9.9") {
+		return fmt.Errorf("expected changelog of the original builder to be unaffected by derived builders, got:\n%s", changelog)
+	}
+	return nil
+}
+
+// Test parsing the changelog context, also when the changelog is written to a file.
+func (m *Tests) TestContext(ctx context.Context) error {
+	base := dag.GitCliff(gitRepo()).WithPreset("conventional")
+
+	var errs []error
+	for name, gc := range map[string]*dagger.GitCliff{
+		"stdout": base,
+		"output": base.WithOutput("CHANGELOG.md"),
+	} {
+		releases, err := gc.Context(ctx)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			continue
+		}
+		if len(releases) != 2 {
+			errs = append(errs, fmt.Errorf("%s: expected 2 releases, got %d", name, len(releases)))
+			continue
+		}
+
+		versions := make(map[string][]string)
+		for _, release := range releases {
+			version, err := release.Version(ctx)
+			if err != nil {
+				return err
+			}
+			commits, err := release.Commits(ctx)
+			if err != nil {
+				return err
+			}
+			for _, commit := range commits {
+				message, err := commit.Message(ctx)
+				if err != nil {
+					return err
+				}
+				group, err := commit.Group(ctx)
+				if err != nil {
+					return err
+				}
+				versions[version] = append(versions[version], group+": "+message)
+			}
+		}
+
+		if !slices.Contains(versions["v1.0.0"], "<!-- 0 -->Features: initial feature") {
+			errs = append(errs, fmt.Errorf("%s: expected v1.0.0 to contain the initial feature, got %v", name, versions["v1.0.0"]))
+		}
+		if !slices.Contains(versions[""], "<!-- 0 -->Features: add widget") {
+			errs = append(errs, fmt.Errorf("%s: expected unreleased changes to contain the widget feature, got %v", name, versions[""]))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Test preparing a release, and failing to release again without unreleased changes.
+func (m *Tests) TestRelease(ctx context.Context) error {
+	release := dag.GitCliff(gitRepo()).WithPreset("conventional").Release()
+
+	version, err := release.Version(ctx)
+	if err != nil {
+		return err
+	}
+	if version != "v1.1.0" {
+		return fmt.Errorf("expected release v1.1.0, got %s", version)
+	}
+
+	notes, err := release.Notes().Contents(ctx)
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(notes, "Add widget") || strings.Contains(notes, "Initial feature") {
+		return fmt.Errorf("expected release notes of v1.1.0 alone, got:\n%s", notes)
+	}
+
+	changelog, err := release.Source().File("CHANGELOG.md").Contents(ctx)
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(changelog, "## [1.1.0]") || !strings.Contains(changelog, "## [1.0.0]") {
+		return fmt.Errorf("expected changelog with v1.1.0 and v1.0.0, got:\n%s", changelog)
+	}
+
+	tag, err := git(release.Source(), "describe", "--tags", "--exact-match").Stdout(ctx)
+	if err != nil {
+		return fmt.Errorf("describing release commit: %w", err)
+	}
+	if strings.TrimSpace(tag) != "v1.1.0" {
+		return fmt.Errorf("expected release commit to be tagged v1.1.0, got %q", tag)
+	}
+
+	_, err = dag.GitCliff(release.Source()).WithPreset("conventional").Release().Version(ctx)
+	if err == nil || !strings.Contains(err.Error(), "no unreleased changes") {
+		return fmt.Errorf("expected releasing without unreleased changes to fail, got %v", err)
+	}
+
+	_, err = dag.GitCliff(gitRepo()).WithPreset("conventional").WithOutput("CHANGES.md").Release().Version(ctx)
+	if err == nil {
+		return errors.New("expected releasing with an output file to fail")
+	}
+	return nil
+}
+
+// Test generating configurations from every preset, and generating a changelog with each.
+func (m *Tests) TestPresets(ctx context.Context) error {
+	gc := dag.GitCliff(gitRepo())
+
+	var errs []error
+	for _, preset := range []string{"act3", "conventional", "github", "keepachangelog"} {
+		config, err := gc.Init(dagger.GitCliffInitOpts{Preset: preset}).Contents(ctx)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("init %s: %w", preset, err))
+			continue
+		}
+		if !strings.Contains(config, "[changelog]") {
+			errs = append(errs, fmt.Errorf("init %s: expected a changelog section, got:\n%s", preset, config))
+		}
+
+		changelog, err := gc.WithPreset(preset).Changelog().Contents(ctx)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("changelog %s: %w", preset, err))
+			continue
+		}
+		if !strings.Contains(strings.ToLower(changelog), "widget") {
+			errs = append(errs, fmt.Errorf("changelog %s: expected the widget feature, got:\n%s", preset, changelog))
+		}
+	}
+
+	if _, err := gc.Init(dagger.GitCliffInitOpts{Preset: "unknown"}).Contents(ctx); err == nil {
+		errs = append(errs, errors.New("expected an unknown preset to fail"))
+	}
+	return errors.Join(errs...)
+}
+
+// Test classifying commits that would be dropped from the changelog, or left without a group.
+func (m *Tests) TestLintCommits(ctx context.Context) error {
+	base := dag.GitCliff(gitRepo()).WithPreset("conventional")
+
+	cases := []struct {
+		name string
+		gc   *dagger.GitCliff
+		// check of each commit with a violation, by message
+		want map[string]string
+	}{
+		{
+			name: "without filter_commits",
+			gc:   base,
+			want: map[string]string{
+				"update readme":       "git-cliff/unconventional",
+				"wip: half a feature": "git-cliff/unclassified",
+			},
+		},
+		{
+			name: "with filter_commits",
+			gc:   base.WithEnvVariable("GIT_CLIFF__GIT__FILTER_COMMITS", "true"),
+			want: map[string]string{
+				"update readme":       "git-cliff/unconventional",
+				"wip: half a feature": "git-cliff/dropped",
+			},
+		},
+	}
+
+	var errs []error
+	for _, tc := range cases {
+		report, err := tc.gc.
+			LintCommits("v1.0.0..HEAD", dagger.GitCliffLintCommitsOpts{NoFail: true}).
+			File("gl-code-quality-report.json").
+			Contents(ctx)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", tc.name, err))
+			continue
+		}
+
+		var issues []codeQualityIssue
+		if err := json.Unmarshal([]byte(report), &issues); err != nil {
+			errs = append(errs, fmt.Errorf("%s: parsing report: %w", tc.name, err))
+			continue
+		}
+		if len(issues) != len(tc.want) {
+			errs = append(errs, fmt.Errorf("%s: expected %d violations, got %d:\n%s", tc.name, len(tc.want), len(issues), report))
+			continue
+		}
+		for message, check := range tc.want {
+			if !slices.ContainsFunc(issues, func(issue codeQualityIssue) bool {
+				return issue.CheckName == check && strings.Contains(issue.Description, message)
+			}) {
+				errs = append(errs, fmt.Errorf("%s: expected %q to be reported as %s:\n%s", tc.name, message, check, report))
+			}
+		}
+	}
+
+	// violations fail the lint unless noFail is set
+	if _, err := base.LintCommits("v1.0.0..HEAD").Sync(ctx); err == nil {
+		errs = append(errs, errors.New("expected violations to fail the lint"))
+	}
+	return errors.Join(errs...)
+}
+
+// codeQualityIssue is the subset of a GitLab code quality issue checked by the tests.
+type codeQualityIssue struct {
+	Description string `json:"description"`
+	CheckName   string `json:"check_name"`
+}
+
+// gitRepo provides a git repository with a v1.0.0 release followed by unreleased commits,
+// including unconventional and unclassified commits. Dependency updates are skipped by the presets.
+func gitRepo() *dagger.Directory {
+	commits := []struct {
+		message string
+		tag     string
+	}{
+		{message: "feat: initial feature", tag: "v1.0.0"},
+		{message: "feat: add widget"},
+		{message: "fix: correct widget size"},
+		{message: "chore(deps): bump dependencies"},
+		{message: "update readme"},
+		{message: "wip: half a feature"},
+	}
+
+	ctr := git(dag.Directory(), "init", "--initial-branch", "main")
+	for _, commit := range commits {
+		ctr = ctr.WithExec([]string{"git", "commit", "--allow-empty", "--message", commit.message})
+		if commit.tag != "" {
+			ctr = ctr.WithExec([]string{"git", "tag", commit.tag})
+		}
+	}
+	return ctr.Directory("/work/src")
+}
+
+// git runs a git command in a git repository.
+func git(src *dagger.Directory, args ...string) *dagger.Container {
+	return dag.Wolfi().
+		Container(dagger.WolfiContainerOpts{Packages: []string{"git"}}).
+		WithMountedDirectory("/work/src", src).
+		WithWorkdir("/work/src").
+		WithEnvVariable("GIT_AUTHOR_NAME", "test").
+		WithEnvVariable("GIT_AUTHOR_EMAIL", "test@example.com").
+		WithEnvVariable("GIT_COMMITTER_NAME", "test").
+		WithEnvVariable("GIT_COMMITTER_EMAIL", "test@example.com").
+		WithExec(append([]string{"git"}, args...))
+}